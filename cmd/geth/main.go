@@ -167,6 +167,10 @@ var (
 		utils.GpoMaxGasPriceFlag,
 		utils.EWASMInterpreterFlag,
 		utils.EVMInterpreterFlag,
+		utils.EVMCSearchPathFlag,
+		utils.EVMCPanicFlag,
+		utils.EVMCSelfTestFlag,
+		utils.NoEwasmFlag,
 		utils.ECBP1100Flag,
 		configFileFlag,
 	}
@@ -207,6 +207,10 @@ var AppHelpFlagGroups = []flags.FlagGroup{
 			utils.VMEnableDebugFlag,
 			utils.EVMInterpreterFlag,
 			utils.EWASMInterpreterFlag,
+			utils.EVMCSearchPathFlag,
+			utils.EVMCPanicFlag,
+			utils.EVMCSelfTestFlag,
+			utils.NoEwasmFlag,
 		},
 	},
 	{
@@ -753,12 +753,29 @@ var (
 	}
 	EWASMInterpreterFlag = cli.StringFlag{
 		Name:  "vm.ewasm",
-		Usage: "External ewasm configuration (default = built-in interpreter)",
+		Usage: "External ewasm configuration, or @file to read it from (default = built-in interpreter)",
 		Value: "",
 	}
 	EVMInterpreterFlag = cli.StringFlag{
 		Name:  "vm.evm",
-		Usage: "External EVM configuration (default = built-in interpreter)",
+		Usage: "External EVM configuration, or @file to read it from (default = built-in interpreter)",
+		Value: "",
+	}
+	NoEwasmFlag = cli.BoolFlag{
+		Name:  "vm.noewasm",
+		Usage: "Disable the Ewasm path, never loading nor using an ewasm VM",
+	}
+	EVMCPanicFlag = cli.BoolFlag{
+		Name:  "vm.panic",
+		Usage: "Panic on internal errors of external VMs instead of failing the execution (debugging)",
+	}
+	EVMCSelfTestFlag = cli.BoolFlag{
+		Name:  "vm.selftest",
+		Usage: "Execute a test contract on external VMs once loaded, failing startup if they are broken",
+	}
+	EVMCSearchPathFlag = cli.StringFlag{
+		Name:  "vm.searchpath",
+		Usage: "Directories external VMs given by name are looked up in, separated like PATH",
 		Value: "",
 	}
 	ECBP1100Flag = cli.Uint64Flag{
@@ -1682,6 +1699,18 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 		cfg.EnablePreimageRecording = ctx.GlobalBool(VMEnableDebugFlag.Name)
 	}
 
+	if ctx.GlobalIsSet(NoEwasmFlag.Name) {
+		vm.SetEwasmDisabled(ctx.GlobalBool(NoEwasmFlag.Name))
+	}
+	if ctx.GlobalIsSet(EVMCPanicFlag.Name) {
+		vm.SetEVMCPanicOnInternalError(ctx.GlobalBool(EVMCPanicFlag.Name))
+	}
+	if ctx.GlobalIsSet(EVMCSelfTestFlag.Name) {
+		vm.SetEVMCSelfTest(ctx.GlobalBool(EVMCSelfTestFlag.Name))
+	}
+	if ctx.GlobalIsSet(EVMCSearchPathFlag.Name) {
+		vm.SetEVMCSearchPaths(filepath.SplitList(ctx.GlobalString(EVMCSearchPathFlag.Name)))
+	}
 	if ctx.GlobalIsSet(EWASMInterpreterFlag.Name) {
 		cfg.EWASMInterpreter = ctx.GlobalString(EWASMInterpreterFlag.Name)
 		vm.InitEVMCEwasm(cfg.EWASMInterpreter)
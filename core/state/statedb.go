@@ -292,6 +292,20 @@ func (s *StateDB) GetCodeSize(addr common.Address) int {
 	return 0
 }
 
+// GetCodeByHash retrieves the contract code with the given hash from the code
+// store, or nil if it's unknown. Code deployed but not yet committed isn't
+// found.
+func (s *StateDB) GetCodeByHash(hash common.Hash) []byte {
+	if hash == common.BytesToHash(emptyCodeHash) {
+		return nil
+	}
+	code, err := s.db.ContractCode(common.Hash{}, hash)
+	if err != nil {
+		return nil
+	}
+	return code
+}
+
 func (s *StateDB) GetCodeHash(addr common.Address) common.Hash {
 	stateObject := s.getStateObject(addr)
 	if stateObject == nil {
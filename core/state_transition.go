@@ -230,6 +230,12 @@ func (st *StateTransition) TransitionDb() (*ExecutionResult, error) {
 	}
 	msg := st.msg
 	sender := vm.AccountRef(msg.From())
+
+	// Messages not checking their nonce (e.g. eth_call) may carry any, so
+	// expose the actual nonce of the origin, before it's incremented below.
+	if !msg.CheckNonce() {
+		st.evm.OriginNonce = st.state.GetNonce(msg.From())
+	}
 	eip2f := st.evm.ChainConfig().IsEnabled(st.evm.ChainConfig().GetEIP2Transition, st.evm.BlockNumber)
 	eip2028f := st.evm.ChainConfig().IsEnabled(st.evm.ChainConfig().GetEIP2028Transition, st.evm.BlockNumber)
 	contractCreation := msg.To() == nil
@@ -60,6 +60,8 @@ type Contract struct {
 
 	Gas   uint64
 	value *big.Int
+
+	IsDeployment bool // Whether the code is the init code of a contract creation
 }
 
 // NewContract returns a new contract environment for the execution of EVM.
@@ -50,6 +50,23 @@ var basePrecompiledContracts = map[common.Address]PrecompiledContract{
 	common.BytesToAddress([]byte{4}): &dataCopy{},
 }
 
+// CustomPrecompile is a chain specific precompiled contract, active from a given
+// block on.
+type CustomPrecompile struct {
+	Address    common.Address
+	Activation uint64
+	Contract   PrecompiledContract
+}
+
+// active returns whether the precompile is active at the given block, taking a
+// missing block number as the genesis block.
+func (p *CustomPrecompile) active(bn *big.Int) bool {
+	if bn == nil {
+		return p.Activation == 0
+	}
+	return !bn.IsUint64() || bn.Uint64() >= p.Activation
+}
+
 // PrecompiledContractsForConfig returns a map containing valid precompiled contracts for a given point in a chain config.
 func PrecompiledContractsForConfig(config ctypes.ChainConfigurator, bn *big.Int) map[common.Address]PrecompiledContract {
 	// Copying to a new map is necessary because assigning to the original map
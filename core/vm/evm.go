@@ -46,15 +46,23 @@ type (
 )
 
 func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
+	for i := range evm.vmConfig.CustomPrecompiles {
+		if custom := &evm.vmConfig.CustomPrecompiles[i]; custom.Address == addr && custom.active(evm.BlockNumber) {
+			return custom.Contract, true
+		}
+	}
 	var precompiles = PrecompiledContractsForConfig(evm.ChainConfig(), evm.BlockNumber)
 	p, ok := precompiles[addr]
 	return p, ok
 }
 
 // run runs the given contract and takes care of running precompiles with a fallback to the byte code interpreter.
+// The contract is dispatched to the first interpreter able to run its code, so EVM1 and
+// Ewasm contracts calling each other each run on their own VM.
 func run(evm *EVM, contract *Contract, input []byte, readOnly bool) ([]byte, error) {
 	for _, interpreter := range evm.interpreters {
 		if interpreter.CanRun(contract.Code) {
+			markInterpreterSelection(interpreter, contract.Code)
 			if evm.interpreter != interpreter {
 				// Ensure that the interpreter pointer is set back
 				// to its current value upon return.
@@ -66,6 +74,7 @@ func run(evm *EVM, contract *Contract, input []byte, readOnly bool) ([]byte, err
 			return interpreter.Run(contract, input, readOnly)
 		}
 	}
+	markInterpreterSelection(nil, contract.Code)
 	return nil, errors.New("no compatible interpreter")
 }
 
@@ -77,12 +86,15 @@ type Context struct {
 	CanTransfer CanTransferFunc
 	// Transfer transfers ether from one account to the other
 	Transfer TransferFunc
-	// GetHash returns the hash corresponding to n
+	// GetHash returns the hash corresponding to n. It is the source of
+	// BLOCKHASH for all interpreters, and can be swapped out to inject
+	// deterministic hashes. A zero hash is passed on to the contract as is.
 	GetHash GetHashFunc
 
 	// Message information
-	Origin   common.Address // Provides information for ORIGIN
-	GasPrice *big.Int       // Provides information for GASPRICE
+	Origin      common.Address // Provides information for ORIGIN
+	OriginNonce uint64         // Nonce of ORIGIN at the start of the transaction, before it is incremented
+	GasPrice    *big.Int       // Provides information for GASPRICE
 
 	// Block information
 	Coinbase    common.Address // Provides information for COINBASE
@@ -128,6 +140,12 @@ type EVM struct {
 	// callErrorTemp holds any errors caused during the execution of system opcodes (0xf0)
 	// NOTE: it's being used only for tracers
 	CallErrorTemp error
+	// evmcFrames is the number of EVMC frames being executed, nested in each
+	// other, by any interpreter.
+	evmcFrames int
+	// evmcActive holds the non-reentrant EVMC VMs running frames of this EVM,
+	// outermost first. The first of them holds evmcLock.
+	evmcActive []evmcVM
 }
 
 // NewEVM returns a new EVM. The returned EVM is not thread safe and should
@@ -144,12 +162,13 @@ func NewEVM(ctx Context, statedb StateDB, chainConfig ctypes.ChainConfigurator,
 
 	// In some implementations, EWASM may be configured with a block number.
 	// In this implementation, the interpreter is configured globally instead.
-	if vmConfig.EWASMInterpreter != "" {
-		evm.interpreters = append(evm.interpreters, &EVMC{ewasmModule, evm, evmc.CapabilityEWASM, false})
+	evm1VM, ewasmVM := evmcVMs()
+	if vmConfig.EWASMInterpreter != "" && !ewasmDisabled {
+		evm.interpreters = append(evm.interpreters, &EVMC{instance: ewasmVM, env: evm, cap: evmc.CapabilityEWASM, stats: evmcStatsOf(ewasmVM)})
 	}
 
 	if vmConfig.EVMInterpreter != "" {
-		evm.interpreters = append(evm.interpreters, &EVMC{evmModule, evm, evmc.CapabilityEVM1, false})
+		evm.interpreters = append(evm.interpreters, &EVMC{instance: evm1VM, env: evm, cap: evmc.CapabilityEVM1, stats: evmcStatsOf(evm1VM)})
 	} else {
 		evm.interpreters = append(evm.interpreters, NewEVMInterpreter(evm, vmConfig))
 	}
@@ -421,6 +440,7 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 	// The contract is a scoped environment for this execution context only.
 	contract := NewContract(caller, AccountRef(address), value, gas)
 	contract.SetCodeOptionalHash(&address, codeAndHash)
+	contract.IsDeployment = true
 
 	if evm.vmConfig.NoRecursion && evm.depth > 0 {
 		return nil, address, gas, nil
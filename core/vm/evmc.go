@@ -21,83 +21,596 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	cmath "github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/evmc/bindings/go/evmc"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params/types/ctypes"
 	"github.com/ethereum/go-ethereum/params/vars"
 	"github.com/holiman/uint256"
 )
 
 // EVMC represents the reference to a common EVMC-based VM instance and
 // the current execution context as required by go-ethereum design.
+//
+// Every EVM gets its own EVMC interpreters, so all the mutable execution state
+// lives here and EVMs may run concurrently. The loaded VM instance is shared
+// between them; the bindings keep the host contexts of concurrent executions
+// apart, and EVMC VMs are required to be reentrant. Go VMs reporting not to
+// be are serialized instead, see evmcReentrancyReporter.
 type EVMC struct {
-	instance *evmc.Instance  // The reference to the EVMC VM instance.
+	instance evmcVM          // The reference to the EVMC VM instance.
 	env      *EVM            // The execution context.
 	cap      evmc.Capability // The supported EVMC capability (EVM or Ewasm)
 	readOnly bool            // The readOnly flag (TODO: Try to get rid of it).
+	active   int             // Number of frames being executed, nested in each other
+
+	profiles []*EVMCGasProfile // Gas profiles of the executed frames, if enabled
+	logs     []*types.Log      // Logs emitted by the frames not reverted so far
+	revert   *evmcRevert       // Origin of the revert of the last finished frame, if reverted
+
+	callbacks     EVMCCallbackCounts // Host callbacks invoked by the executed frames
+	precompileGas uint64             // Gas consumed by precompiled contracts called by the executed frames
+	stats         *evmcStats         // Execution statistics of the VM, if collected
+}
+
+// ErrEVMCOutOfGas is returned when an EVMC VM runs out of gas, carrying the gas
+// the execution started with. The VMs don't report how much gas the failing
+// operation required.
+type ErrEVMCOutOfGas struct {
+	available uint64
+}
+
+func (e *ErrEVMCOutOfGas) Error() string {
+	return fmt.Sprintf("%v (available %d)", ErrOutOfGas, e.available)
+}
+
+// Unwrap returns ErrOutOfGas, so the error matches it with errors.Is.
+func (e *ErrEVMCOutOfGas) Unwrap() error {
+	return ErrOutOfGas
+}
+
+// evmcVM is the part of the evmc.Instance API used for executing code. It
+// allows substituting the loaded VM in tests.
+type evmcVM interface {
+	Execute(ctx evmc.HostContext, rev evmc.Revision,
+		kind evmc.CallKind, static bool, depth int, gas int64,
+		destination common.Address, sender common.Address, input []byte, value common.Hash,
+		code []byte, create2Salt common.Hash) (output []byte, gasLeft int64, err error)
+}
+
+// evmcModule is a loaded VM, along with the statistics of its executions.
+type evmcModule struct {
+	stats evmcStats // First, to be 64-bit aligned for atomic access
+	*evmc.Instance
+}
+
+// evmcStatsOf returns the execution statistics of the VM, or nil for VMs not
+// loaded from a shared library.
+func evmcStatsOf(vm evmcVM) *evmcStats {
+	if module, ok := vm.(*evmcModule); ok && module != nil {
+		return &module.stats
+	}
+	return nil
 }
 
 var (
-	evmModule       *evmc.Instance
-	ewasmModule     *evmc.Instance
-	evmcModuleError = errors.New("EVMC internal error")
+	evmModule         *evmcModule
+	ewasmModule       *evmcModule
+	evmcModuleError   = errors.New("EVMC internal error")
+	evmcTimeoutError  = errors.New("EVMC execution timeout")
+	evmcPanicError    = errors.New("EVMC VM panic")
+	evmcOutputError   = errors.New("EVMC output size limit exceeded")
+	evmcReentryError  = errors.New("EVMC VM is not reentrant")
+	evmcSnapshotError = errors.New("EVMC VM reverted to an unknown snapshot")
 )
 
+// evmcVMs returns the EVM1 and Ewasm VMs run by the EVMC interpreters of new
+// EVMs. It allows substituting Go VMs in tests.
+var evmcVMs = func() (evm1 evmcVM, ewasm evmcVM) {
+	return evmModule, ewasmModule
+}
+
 func InitEVMCEVM(config string) {
-	evmModule = initEVMC(evmc.CapabilityEVM1, config)
+	if err := InitEVMCEVMContext(context.Background(), config); err != nil {
+		panic(err)
+	}
 }
 
 func InitEVMCEwasm(config string) {
-	ewasmModule = initEVMC(evmc.CapabilityEWASM, config)
+	if err := InitEVMCEwasmContext(context.Background(), config); err != nil {
+		panic(err)
+	}
+}
+
+// InitEVMCEVMContext loads the EVM1 VM like InitEVMCEVM, giving up with an
+// error once the context is done.
+func InitEVMCEVMContext(ctx context.Context, config string) error {
+	instance, err := initEVMC(ctx, evmc.CapabilityEVM1, config)
+	if err != nil {
+		return err
+	}
+	evmModule = &evmcModule{Instance: instance}
+	return nil
+}
+
+// InitEVMCEwasmContext loads the Ewasm VM like InitEVMCEwasm, giving up with
+// an error once the context is done.
+func InitEVMCEwasmContext(ctx context.Context, config string) error {
+	if ewasmDisabled {
+		evmcLogger().Warn("Ewasm is disabled, not loading the EVMC Ewasm VM", "config", config)
+		return nil
+	}
+	instance, err := initEVMC(ctx, evmc.CapabilityEWASM, config)
+	if err != nil {
+		return err
+	}
+	ewasmModule = &evmcModule{Instance: instance}
+	return nil
+}
+
+// ewasmDisabled turns off the Ewasm path, for nodes running EVM1 only.
+var ewasmDisabled bool
+
+// SetEwasmDisabled turns the Ewasm path off or on. While disabled no Ewasm VM
+// is loaded nor used, so code is never routed to Ewasm. Wasm code fails with
+// an error on EVMC EVM1 VMs, and is run as EVM bytecode by the built-in
+// interpreter, as required by consensus. It needs to be called before the VMs
+// are loaded.
+func SetEwasmDisabled(disabled bool) {
+	ewasmDisabled = disabled
+}
+
+var (
+	evmcLog   = log.Root() // Logger of the EVMC subsystem
+	evmcLogMu sync.RWMutex
+)
+
+// SetEVMCLogger routes the logs of the EVMC subsystem to the given logger, or
+// back to the root logger if nil. It is safe to be called concurrently with
+// running executions.
+func SetEVMCLogger(logger log.Logger) {
+	if logger == nil {
+		logger = log.Root()
+	}
+	evmcLogMu.Lock()
+	evmcLog = logger
+	evmcLogMu.Unlock()
+}
+
+// evmcLogger returns the logger of the EVMC subsystem.
+func evmcLogger() log.Logger {
+	evmcLogMu.RLock()
+	defer evmcLogMu.RUnlock()
+	return evmcLog
+}
+
+// evmcPanicOnInternalError makes internal errors of the VM panic instead of
+// failing the execution.
+var evmcPanicOnInternalError bool
+
+// evmcInternalPanic is the panic raised on internal VM errors in fail-fast mode.
+type evmcInternalPanic string
+
+// SetEVMCPanicOnInternalError selects between failing fast with a panic, for
+// debugging, or failing just the execution, for production, when the VM
+// reports an internal error.
+func SetEVMCPanicOnInternalError(enabled bool) {
+	evmcPanicOnInternalError = enabled
+}
+
+// evmcSearchPaths lists the directories VMs configured by name are looked up in.
+var evmcSearchPaths []string
+
+// SetEVMCSearchPaths sets the directories EVMC VMs configured by name (e.g.
+// --vm.evm=evmone) are looked up in, in order. It needs to be called before
+// the VMs are loaded.
+func SetEVMCSearchPaths(dirs []string) {
+	evmcSearchPaths = dirs
+}
+
+// resolveEVMCPath resolves a VM configured by name against the search
+// directories, trying both the plain name and the shared library file name
+// of the platform (e.g. libevmone.so). The first match wins. Paths, and names
+// not found in any of the directories, are returned as is, leaving them to
+// the dynamic loader.
+func resolveEVMCPath(name string, dirs []string) string {
+	if filepath.Base(name) != name {
+		return name
+	}
+	var found []string
+	for _, dir := range dirs {
+		for _, file := range []string{name, "lib" + name + sharedLibraryExt()} {
+			path := filepath.Join(dir, file)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				found = append(found, path)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return name
+	}
+	if len(found) > 1 {
+		evmcLogger().Info("Multiple EVMC VMs found, using the first", "name", name, "path", found[0], "ignored", found[1:])
+	}
+	return found[0]
+}
+
+// sharedLibraryExt returns the file extension of shared libraries on the
+// current platform.
+func sharedLibraryExt() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return ".dylib"
+	case "windows":
+		return ".dll"
+	default:
+		return ".so"
+	}
+}
+
+// readEVMCConfigFile reads a VM configuration from a file, for the --vm.(evm|ewasm)
+// values in the form of @/path/to/file. The file holds the path of the VM on the
+// first line followed by one name=value option per line. Blank lines and lines
+// starting with # are ignored. Unlike on the command line, option values may
+// contain commas.
+func readEVMCConfigFile(file string) (path string, options []string, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read EVMC VM configuration: %v", err)
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if path == "" {
+			path = line
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			return "", nil, fmt.Errorf("invalid EVMC VM option in %s on line %d: %q, want name=value", file, i+1, line)
+		}
+		options = append(options, line)
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("no EVMC VM path in %s", file)
+	}
+	return path, options, nil
+}
+
+// evmcLoad loads a VM from a shared library. It allows substituting the
+// loader in tests.
+var evmcLoad = evmc.Load
+
+// evmcInit and evmcDestroy set up, respectively tear down, a VM. They allow
+// substituting the lifecycle of the VMs in tests.
+var (
+	evmcInit    = loadEVMC
+	evmcDestroy = (*evmc.Instance).Destroy
+)
+
+// evmcAfterFunc arms the timeout of an execution like time.AfterFunc, returning
+// the function disarming it. It allows substituting the timer in tests.
+var evmcAfterFunc = func(d time.Duration, f func()) (stop func() bool) {
+	return time.AfterFunc(d, f).Stop
+}
+
+// initEVMC loads and sets up the VM, panicking if it fails, or returning an
+// error if the context is done first. Loading a library can't be interrupted,
+// so a VM still loading when the context is done is destroyed once loaded.
+func initEVMC(ctx context.Context, cap evmc.Capability, config string) (*evmc.Instance, error) {
+	type loaded struct {
+		instance *evmc.Instance
+		err      interface{}
+	}
+	var (
+		done      = make(chan loaded)
+		abandoned = make(chan struct{})
+	)
+	go func() {
+		var l loaded
+		func() {
+			defer func() { l.err = recover() }()
+			l.instance = evmcInit(cap, config)
+		}()
+		// The result is either handed over, or discarded if the caller gave
+		// up, which can't happen both as done is unbuffered.
+		select {
+		case done <- l:
+		case <-abandoned:
+			if l.instance != nil {
+				evmcLogger().Info("Destroying EVMC VM loaded after being given up on", "config", config)
+				evmcDestroy(l.instance)
+			}
+		}
+	}()
+	select {
+	case l := <-done:
+		if l.err != nil {
+			panic(l.err)
+		}
+		return l.instance, nil
+	case <-ctx.Done():
+		close(abandoned)
+		return nil, fmt.Errorf("loading the EVMC VM %q aborted: %v", config, ctx.Err())
+	}
 }
 
-func initEVMC(cap evmc.Capability, config string) *evmc.Instance {
-	options := strings.Split(config, ",")
-	path := options[0]
+// loadEVMC loads the VM given by the --vm.(evm|ewasm) configuration, sets its
+// options and checks it is usable, panicking otherwise.
+func loadEVMC(cap evmc.Capability, config string) *evmc.Instance {
+	var (
+		path    string
+		options []string
+	)
+	if strings.HasPrefix(config, "@") {
+		var err error
+		if path, options, err = readEVMCConfigFile(config[1:]); err != nil {
+			panic(err.Error())
+		}
+	} else {
+		options = strings.Split(config, ",")
+		path, options = options[0], options[1:]
+	}
 
 	if path == "" {
 		panic("EVMC VM path not provided, set --vm.(evm|ewasm)=/path/to/vm")
 	}
+	path = resolveEVMCPath(path, evmcSearchPaths)
 
-	instance, err := evmc.Load(path)
+	instance, err := evmcLoad(path)
 	if err != nil {
 		panic(err.Error())
 	}
-	log.Info("EVMC VM loaded", "name", instance.Name(), "version", instance.Version(), "path", path)
+	evmcLogger().Info("EVMC VM loaded", "name", instance.Name(), "version", instance.Version(), "abi", instance.ABIVersion(), "path", path)
+
+	if err := checkEVMCABIVersion(instance.ABIVersion()); err != nil {
+		panic(fmt.Errorf("The EVMC module %s is incompatible: %v", path, err))
+	}
 
 	// Set options before checking capabilities.
-	for _, option := range options[1:] {
-		if idx := strings.Index(option, "="); idx >= 0 {
-			name := option[:idx]
-			value := option[idx+1:]
-			err := instance.SetOption(name, value)
-			if err == nil {
-				log.Info("EVMC VM option set", "name", name, "value", value)
-			} else {
-				log.Warn("EVMC VM option setting failed", "name", name, "error", err)
-			}
+	for _, option := range scopeEVMCOptions(cap, options) {
+		err := instance.SetOption(option.name, option.value)
+		if err == nil {
+			evmcLogger().Info("EVMC VM option set", "name", option.name, "value", option.value)
+		} else {
+			evmcLogger().Warn("EVMC VM option setting failed", "name", option.name, "error", err)
 		}
 	}
 
 	if !instance.HasCapability(cap) {
 		panic(fmt.Errorf("The EVMC module %s does not have requested capability %d", path, cap))
 	}
+	if evmcSelfTest && cap == evmc.CapabilityEVM1 {
+		if err := selfTestEVMC(instance); err != nil {
+			panic(fmt.Errorf("The EVMC module %s failed the self-test: %v", path, err))
+		}
+		evmcLogger().Info("EVMC VM self-test passed", "name", instance.Name())
+	}
 	return instance
 }
 
+// evmcOption is a name=value option to be set on a VM.
+type evmcOption struct {
+	name  string
+	value string
+}
+
+// evmcOptionScopes maps the prefixes of capability-scoped options to the
+// capability they target.
+var evmcOptionScopes = map[string]evmc.Capability{
+	"evm1.":  evmc.CapabilityEVM1,
+	"ewasm.": evmc.CapabilityEWASM,
+}
+
+// scopeEVMCOptions returns the options to be set on the VM loaded for the given
+// capability. Options may be scoped to a capability by prefixing them with
+// evm1. or ewasm., e.g. ewasm.metering=true, so a configuration shared by the
+// EVM1 and Ewasm VMs can carry options valid for one of them only. Scoped options
+// are set without the prefix on the VM of their capability and skipped on the
+// other, unscoped ones are set on both. Malformed options are skipped.
+func scopeEVMCOptions(cap evmc.Capability, options []string) []evmcOption {
+	var scoped []evmcOption
+	for _, option := range options {
+		idx := strings.Index(option, "=")
+		if idx < 0 {
+			continue
+		}
+		name, value := option[:idx], option[idx+1:]
+		for prefix, target := range evmcOptionScopes {
+			if strings.HasPrefix(name, prefix) {
+				if target != cap {
+					evmcLogger().Debug("Skipping EVMC VM option of other capability", "name", name)
+					name = ""
+				} else {
+					name = name[len(prefix):]
+				}
+				break
+			}
+		}
+		if name != "" {
+			scoped = append(scoped, evmcOption{name, value})
+		}
+	}
+	return scoped
+}
+
+// evmcSelfTest enables running a test contract on the VMs once loaded.
+var evmcSelfTest bool
+
+// SetEVMCSelfTest enables or disables the self-test of EVM1 VMs after loading,
+// so VMs which load but fail to execute code are caught at startup instead of
+// on the first transaction. It needs to be called before the VMs are loaded.
+func SetEVMCSelfTest(enabled bool) {
+	evmcSelfTest = enabled
+}
+
+var (
+	// evmcSelfTestCode stores 0x2a in memory and returns it:
+	// PUSH1 0x2a PUSH1 0 MSTORE8 PUSH1 1 PUSH1 0 RETURN
+	evmcSelfTestCode = []byte{0x60, 0x2a, 0x60, 0x00, 0x53, 0x60, 0x01, 0x60, 0x00, 0xf3}
+
+	evmcSelfTestGas     = int64(100000)
+	evmcSelfTestGasUsed = int64(18)
+)
+
+// selfTestEVMC runs evmcSelfTestCode on the VM, returning an error unless it
+// produces the expected result. Panics of the VM are turned into errors;
+// crashes of native VMs can't be recovered from and bring the node down, at
+// startup rather than while processing blocks.
+func selfTestEVMC(vm evmcVM) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("VM panicked: %v", r)
+		}
+	}()
+	output, gasLeft, err := vm.Execute(evmcSelfTestHost{}, evmc.Frontier, evmc.Call, false, 0, evmcSelfTestGas,
+		common.Address{}, common.Address{}, nil, common.Hash{}, evmcSelfTestCode, common.Hash{})
+	switch {
+	case err != nil:
+		return fmt.Errorf("execution failed: %v", err)
+	case !bytes.Equal(output, []byte{0x2a}):
+		return fmt.Errorf("output mismatch: have %x, want 2a", output)
+	case gasLeft != evmcSelfTestGas-evmcSelfTestGasUsed:
+		return fmt.Errorf("gas left mismatch: have %d, want %d", gasLeft, evmcSelfTestGas-evmcSelfTestGasUsed)
+	}
+	return nil
+}
+
+// evmcSelfTestHost is the host of the self-test execution. The test code doesn't
+// access the state nor the environment, so it answers every query with zero
+// values and ignores every modification.
+type evmcSelfTestHost struct{}
+
+func (evmcSelfTestHost) AccountExists(common.Address) bool                  { return false }
+func (evmcSelfTestHost) GetStorage(common.Address, common.Hash) common.Hash { return common.Hash{} }
+func (evmcSelfTestHost) SetStorage(common.Address, common.Hash, common.Hash) evmc.StorageStatus {
+	return evmc.StorageUnchanged
+}
+func (evmcSelfTestHost) GetBalance(common.Address) common.Hash         { return common.Hash{} }
+func (evmcSelfTestHost) GetCodeSize(common.Address) int                { return 0 }
+func (evmcSelfTestHost) GetCodeHash(common.Address) common.Hash        { return common.Hash{} }
+func (evmcSelfTestHost) GetCode(common.Address) []byte                 { return nil }
+func (evmcSelfTestHost) Selfdestruct(common.Address, common.Address)   {}
+func (evmcSelfTestHost) GetTxContext() evmc.TxContext                  { return evmc.TxContext{} }
+func (evmcSelfTestHost) GetBlockHash(int64) common.Hash                { return common.Hash{} }
+func (evmcSelfTestHost) EmitLog(common.Address, []common.Hash, []byte) {}
+func (evmcSelfTestHost) Call(evmc.CallKind, common.Address, common.Address, *big.Int, []byte, int64, int,
+	bool, *big.Int) ([]byte, int64, common.Address, error) {
+	return nil, 0, common.Address{}, evmc.Failure
+}
+
+// supportedEVMCABIVersions lists the EVMC ABI versions the host is able to
+// talk to. Both the VM instance and the host interface layout change between
+// ABI versions, so only the version the bindings are built against is safe.
+var supportedEVMCABIVersions = map[int]bool{
+	evmc.ABIVersion: true,
+}
+
+// checkEVMCABIVersion returns an error if a VM implementing the given EVMC ABI
+// version can't be used by the host.
+func checkEVMCABIVersion(version int) error {
+	switch {
+	case supportedEVMCABIVersions[version]:
+		return nil
+	case version > evmc.ABIVersion:
+		return fmt.Errorf("EVMC ABI version %d is newer than supported (%d), the VM requires newer bindings", version, evmc.ABIVersion)
+	default:
+		return fmt.Errorf("unsupported EVMC ABI version %d (supported: %d)", version, evmc.ABIVersion)
+	}
+}
+
+// EVMCABIVersions returns the EVMC ABI versions the loaded EVM1 and Ewasm VMs
+// were built against, or zero for the VMs not loaded.
+func EVMCABIVersions() (evm1 int, ewasm int) {
+	if evmModule != nil {
+		evm1 = evmModule.ABIVersion()
+	}
+	if ewasmModule != nil {
+		ewasm = ewasmModule.ABIVersion()
+	}
+	return evm1, ewasm
+}
+
 // hostContext implements evmc.HostContext interface.
 type hostContext struct {
-	env      *EVM      // The reference to the EVM execution context.
-	contract *Contract // The reference to the current contract, needed by Call-like methods.
+	env         *EVM            // The reference to the EVM execution context.
+	interpreter *EVMC           // The interpreter running the frame.
+	contract    *Contract       // The reference to the current contract, needed by Call-like methods.
+	profile     *EVMCGasProfile // The gas profile of the frame, nil if profiling is disabled.
+
+	writeViolation bool           // Whether the VM attempted a state modification in read-only mode.
+	badSnapshot    bool           // Whether the VM attempted to revert to a snapshot it didn't take.
+	pendingLogs    []types.Log    // Logs emitted since the last flush.
+	snapshots      []hostSnapshot // Snapshots taken by the VM.
+
+	subRevert    *evmcRevert        // Revert of the last sub-call, if reverted.
+	subCallbacks EVMCCallbackCounts // Host callbacks invoked up to the return of the last sub-call.
+}
+
+// hostSnapshot is a state snapshot taken by the VM, along with the number of
+// logs emitted so far, to drop the later ones on revert.
+type hostSnapshot struct {
+	id   int
+	logs int
+}
+
+// writeProtected reports whether the frame runs in read-only mode, flagging
+// the frame as violating the write protection if so. The host callbacks have
+// no way to fail, so the modification is dropped and the frame fails once the
+// VM returns.
+func (host *hostContext) writeProtected() bool {
+	if host.interpreter.readOnly {
+		host.writeViolation = true
+	}
+	return host.writeViolation
+}
+
+// evmcHostPanic wraps a panic raised by a host callback, i.e. by the node rather
+// than by the VM, so it isn't taken for a crash of the VM on its way up.
+type evmcHostPanic struct {
+	value interface{} // Original panic value
+	stack []byte      // Stack trace at the panic
+}
+
+func (p *evmcHostPanic) String() string {
+	return fmt.Sprintf("%v [in EVMC host callback]\n\n%s", p.value, p.stack)
+}
+
+// guard is deferred by the host callbacks, passing their panics on as
+// evmcHostPanic.
+func (host *hostContext) guard() {
+	if r := recover(); r != nil {
+		switch r.(type) {
+		case *evmcHostPanic, evmcInternalPanic:
+		default:
+			r = &evmcHostPanic{value: r, stack: debug.Stack()}
+		}
+		panic(r)
+	}
 }
 
 func (host *hostContext) AccountExists(addr common.Address) bool {
+	defer host.guard()
+	host.interpreter.callbacks.AccountExists++
 	// if host.env.ChainConfig().IsEIP158(host.env.BlockNumber) {
 	if host.env.ChainConfig().IsEnabled(host.env.ChainConfig().GetEIP161dTransition, host.env.BlockNumber) {
 		if !host.env.StateDB.Empty(addr) {
@@ -110,12 +623,39 @@ func (host *hostContext) AccountExists(addr common.Address) bool {
 }
 
 func (host *hostContext) GetStorage(addr common.Address, key common.Hash) common.Hash {
+	defer host.guard()
+	host.interpreter.callbacks.GetStorage++
+	if host.profile != nil {
+		host.profile.Storage += sloadGas(host.env)
+	}
 	return host.env.StateDB.GetState(addr, key)
 }
 
+// EVMCNoopSStoreFunc returns the storage status reported to EVMC VMs, and the
+// gas to refund, for an SSTORE writing the value the slot already holds. VMs
+// charge the SSTORE by the status, so chains metering such writes differently
+// than the revision they run can map them to the status of the right cost.
+type EVMCNoopSStoreFunc func(env *EVM, addr common.Address, key common.Hash) (status evmc.StorageStatus, refund uint64)
+
 func (host *hostContext) SetStorage(addr common.Address, key common.Hash, value common.Hash) (status evmc.StorageStatus) {
+	defer host.guard()
+	host.interpreter.callbacks.SetStorage++
+	if host.writeProtected() {
+		return evmc.StorageUnchanged
+	}
+	if host.profile != nil {
+		defer func() { host.profile.Storage += sstoreGas(host.env, status) }()
+	}
 	oldValue := host.env.StateDB.GetState(addr, key)
 	if oldValue == value {
+		if noop := host.env.vmConfig.EVMCNoopSStore; noop != nil {
+			var refund uint64
+			status, refund = noop(host.env, addr, key)
+			if refund > 0 {
+				host.env.StateDB.AddRefund(refund)
+			}
+			return status
+		}
 		return evmc.StorageUnchanged
 	}
 
@@ -123,7 +663,7 @@ func (host *hostContext) SetStorage(addr common.Address, key common.Hash, value
 	original := host.env.StateDB.GetCommittedState(addr, key)
 
 	host.env.StateDB.SetState(addr, key, value)
-	
+
 	// Here's a great example of one of the limits of our (core-geth) current chainconfig interface model.
 	// Should we handle the logic here about historic-featuro logic (which really is nice, because when reading the strange-incantation implemations, it's nice to see why it is),
 	// or should we handle the question where we handle the rest of the questions like this, since this logic is
@@ -153,7 +693,7 @@ func (host *hostContext) SetStorage(addr common.Address, key common.Hash, value
 
 	if hasEIP2200 {
 		resetClearRefund = vars.SstoreSetGasEIP2200 - vars.SloadGasEIP2200 // 19200
-		cleanRefund = vars.SstoreResetGasEIP2200 - vars.SloadGasEIP2200 // 4200
+		cleanRefund = vars.SstoreResetGasEIP2200 - vars.SloadGasEIP2200    // 4200
 	}
 
 	if original == current {
@@ -184,14 +724,75 @@ func (host *hostContext) SetStorage(addr common.Address, key common.Hash, value
 }
 
 func (host *hostContext) GetBalance(addr common.Address) common.Hash {
-	return common.BigToHash(host.env.StateDB.GetBalance(addr))
+	defer host.guard()
+	host.interpreter.callbacks.GetBalance++
+	if host.profile != nil {
+		host.profile.Account += balanceGas(host.env, addr == host.contract.Address())
+	}
+	return bigToHash(host.env.StateDB.GetBalance(addr))
+}
+
+// bigToHash is common.BigToHash without allocating the intermediate bytes, for
+// the callbacks VMs may invoke in tight loops (BALANCE, SELFBALANCE). The hash
+// is built on the stack and returned by value, so nothing is shared between
+// concurrent executions.
+func bigToHash(b *big.Int) (h common.Hash) {
+	cmath.ReadBits(b, h[:])
+	return h
 }
 
 func (host *hostContext) GetCodeSize(addr common.Address) int {
+	defer host.guard()
+	host.interpreter.callbacks.GetCodeSize++
+	if host.profile != nil {
+		host.profile.Account += accountAccessGas(host.env, false)
+	}
 	return host.env.StateDB.GetCodeSize(addr)
 }
 
+func (host *hostContext) IsPrecompile(addr common.Address) bool {
+	defer host.guard()
+	host.interpreter.callbacks.IsPrecompile++
+	_, ok := host.env.precompile(addr)
+	return ok
+}
+
+func (host *hostContext) GetInputSize() int {
+	defer host.guard()
+	host.interpreter.callbacks.GetInputSize++
+	return len(host.contract.Input)
+}
+
+func (host *hostContext) GetAddress() common.Address {
+	defer host.guard()
+	host.interpreter.callbacks.GetAddress++
+	return host.contract.Address()
+}
+
+func (host *hostContext) GetCaller() common.Address {
+	defer host.guard()
+	host.interpreter.callbacks.GetCaller++
+	return host.contract.Caller()
+}
+
+func (host *hostContext) GetOriginNonce() uint64 {
+	defer host.guard()
+	host.interpreter.callbacks.GetOriginNonce++
+	return host.env.OriginNonce
+}
+
+func (host *hostContext) GetCodeByHash(hash common.Hash) []byte {
+	defer host.guard()
+	host.interpreter.callbacks.GetCodeByHash++
+	return host.env.StateDB.GetCodeByHash(hash)
+}
+
 func (host *hostContext) GetCodeHash(addr common.Address) common.Hash {
+	defer host.guard()
+	host.interpreter.callbacks.GetCodeHash++
+	if host.profile != nil {
+		host.profile.Account += extcodeHashGas(host.env)
+	}
 	if host.env.StateDB.Empty(addr) {
 		return common.Hash{}
 	}
@@ -199,10 +800,38 @@ func (host *hostContext) GetCodeHash(addr common.Address) common.Hash {
 }
 
 func (host *hostContext) GetCode(addr common.Address) []byte {
+	defer host.guard()
+	host.interpreter.callbacks.GetCode++
 	return host.env.StateDB.GetCode(addr)
 }
 
+// GetCodeSlice implements evmc.CodeSliceGetter.
+func (host *hostContext) GetCodeSlice(addr common.Address, offset uint64, size uint64) []byte {
+	defer host.guard()
+	host.interpreter.callbacks.GetCode++
+	if host.profile != nil {
+		host.profile.Account += accountAccessGas(host.env, false)
+	}
+	code := host.env.StateDB.GetCode(addr)
+	if offset >= uint64(len(code)) {
+		return nil
+	}
+	end := uint64(len(code))
+	if size < end-offset {
+		end = offset + size
+	}
+	return code[offset:end]
+}
+
 func (host *hostContext) Selfdestruct(addr common.Address, beneficiary common.Address) {
+	defer host.guard()
+	host.interpreter.callbacks.Selfdestruct++
+	if host.writeProtected() {
+		return
+	}
+	if host.profile != nil {
+		host.profile.Account += selfdestructGas(host.env)
+	}
 	db := host.env.StateDB
 	if !db.HasSuicided(addr) {
 		db.AddRefund(vars.SelfdestructRefundGas)
@@ -212,19 +841,30 @@ func (host *hostContext) Selfdestruct(addr common.Address, beneficiary common.Ad
 }
 
 func (host *hostContext) GetTxContext() evmc.TxContext {
+	defer host.guard()
+	host.interpreter.callbacks.GetTxContext++
+	// The EVMC ABI carries the gas limit as a signed integer, saturate it
+	// instead of reporting a negative limit for (private) chains going
+	// beyond 2^63-1.
+	gasLimit := int64(math.MaxInt64)
+	if host.env.GasLimit < math.MaxInt64 {
+		gasLimit = int64(host.env.GasLimit)
+	}
 	return evmc.TxContext{
-		GasPrice:   common.BigToHash(host.env.GasPrice),
+		GasPrice:   bigToHash(host.env.GasPrice),
 		Origin:     host.env.Origin,
 		Coinbase:   host.env.Coinbase,
 		Number:     host.env.BlockNumber.Int64(),
 		Timestamp:  host.env.Time.Int64(),
-		GasLimit:   int64(host.env.GasLimit),
-		Difficulty: common.BigToHash(host.env.Difficulty),
+		GasLimit:   gasLimit,
+		Difficulty: bigToHash(host.env.Difficulty),
 		//ChainID:    common.BigToHash(host.env.chainConfig.GetChainID()),
 	}
 }
 
 func (host *hostContext) GetBlockHash(number int64) common.Hash {
+	defer host.guard()
+	host.interpreter.callbacks.GetBlockHash++
 	b := host.env.BlockNumber.Int64()
 	if number >= (b-256) && number < b {
 		return host.env.GetHash(uint64(number))
@@ -233,7 +873,12 @@ func (host *hostContext) GetBlockHash(number int64) common.Hash {
 }
 
 func (host *hostContext) EmitLog(addr common.Address, topics []common.Hash, data []byte) {
-	host.env.StateDB.AddLog(&types.Log{
+	defer host.guard()
+	host.interpreter.callbacks.EmitLog++
+	if host.writeProtected() {
+		return
+	}
+	host.pendingLogs = append(host.pendingLogs, types.Log{
 		Address:     addr,
 		Topics:      topics,
 		Data:        data,
@@ -241,13 +886,85 @@ func (host *hostContext) EmitLog(addr common.Address, topics []common.Hash, data
 	})
 }
 
+// flushLogs hands the logs emitted so far over to the state. Logs are batched
+// to save an allocation per log, and flushed before every sub-call to keep
+// them in execution order. The unflushed logs of a failed frame are dropped.
+func (host *hostContext) flushLogs() {
+	for i := range host.pendingLogs {
+		log := &host.pendingLogs[i]
+		host.env.StateDB.AddLog(log)
+		host.interpreter.logs = append(host.interpreter.logs, log)
+	}
+	host.pendingLogs = nil
+}
+
+func (host *hostContext) Snapshot() int {
+	defer host.guard()
+	host.interpreter.callbacks.Snapshot++
+	host.flushLogs()
+	id := host.env.StateDB.Snapshot()
+	host.snapshots = append(host.snapshots, hostSnapshot{id, len(host.interpreter.logs)})
+	return id
+}
+
+func (host *hostContext) RevertToSnapshot(id int) {
+	defer host.guard()
+	host.interpreter.callbacks.RevertToSnapshot++
+	host.flushLogs()
+	for i := len(host.snapshots) - 1; i >= 0; i-- {
+		if host.snapshots[i].id == id {
+			host.interpreter.logs = host.interpreter.logs[:host.snapshots[i].logs]
+			host.snapshots = host.snapshots[:i]
+			host.env.StateDB.RevertToSnapshot(id)
+			return
+		}
+	}
+	// The StateDB panics on ids it doesn't know or reverted already, so
+	// fail the frame instead of letting a buggy VM crash the node.
+	evmcLogger().Error("EVMC: Revert to unknown snapshot", "id", id, "address", host.contract.Address())
+	host.badSnapshot = true
+}
+
 func (host *hostContext) Call(kind evmc.CallKind,
 	destination common.Address, sender common.Address, value *big.Int, input []byte, gas int64, depth int,
 	static bool, salt *big.Int) (output []byte, gasLeft int64, createAddr common.Address, err error) {
 
+	defer host.guard()
+	host.interpreter.callbacks.Call++
 	gasU := uint64(gas)
 	var gasLeftU uint64
 
+	host.flushLogs()
+
+	// Don't start new sub-calls once the execution was aborted, e.g. due to
+	// a timeout, so the VM winds down as fast as possible.
+	if host.env.Cancelled() {
+		return nil, 0, common.Address{}, evmc.Failure
+	}
+
+	// Contract creation and value transfers modify the state, so don't rely
+	// on the VM to enforce the write protection of static contexts. Like the
+	// native interpreter, attempting them fails the whole frame.
+	writes := kind == evmc.Create || kind == evmc.Create2 || (kind == evmc.Call && value != nil && value.Sign() > 0)
+	if writes && (static || host.writeProtected()) {
+		host.writeViolation = true
+		return nil, 0, common.Address{}, evmc.Failure
+	}
+	static = static || host.interpreter.readOnly
+
+	// Output beyond the size limit fails the call. The callee may have
+	// completed already, so its state changes need to be undone.
+	maxOutput := host.env.vmConfig.EVMCMaxOutputSize
+	var snapshot hostSnapshot
+	if maxOutput > 0 {
+		snapshot = hostSnapshot{host.env.StateDB.Snapshot(), len(host.interpreter.logs)}
+	}
+
+	// The frame of the sub-call records the origin of its revert, if any.
+	host.interpreter.revert = nil
+
+	// The VM adds the call stipend of value transfers to the forwarded gas, so
+	// unlike opCall the host passes the gas through as is.
 	switch kind {
 	case evmc.Call:
 		if static {
@@ -260,31 +977,41 @@ func (host *hostContext) Call(kind evmc.CallKind,
 	case evmc.CallCode:
 		output, gasLeftU, err = host.env.CallCode(host.contract, destination, input, gasU, value)
 	case evmc.Create:
-		var createOutput []byte
-		createOutput, createAddr, gasLeftU, err = host.env.Create(host.contract, input, gasU, value)
-		isHomestead := host.env.ChainConfig().IsEnabled(host.env.ChainConfig().GetEIP7Transition, host.env.BlockNumber)
-		if !isHomestead && err == ErrCodeStoreOutOfGas {
+		var ret []byte
+		ret, createAddr, gasLeftU, err = host.env.Create(host.contract, input, gasU, value)
+		// Before EIP-2 running out of gas for the code deposit leaves an
+		// empty account behind instead of failing the creation.
+		if !host.env.ChainConfig().IsEnabled(host.env.ChainConfig().GetEIP2Transition, host.env.BlockNumber) && err == ErrCodeStoreOutOfGas {
 			err = nil
 		}
-		if err == ErrExecutionReverted {
-			// Assign return buffer from REVERT.
-			// TODO: Bad API design: return data buffer and the code is returned in the same place. In worst case
-			//       the code is returned also when there is not enough funds to deploy the code.
-			output = createOutput
-		}
+		output = createOutput(ret, err)
 	case evmc.Create2:
-		var createOutput []byte
-		var saltUint256 = new(uint256.Int)
-		saltUint256.SetUint64(salt.Uint64())
-		createOutput, createAddr, gasLeftU, err = host.env.Create2(host.contract, input, gasU, value, saltUint256)
-		if err == ErrExecutionReverted {
-			// Assign return buffer from REVERT.
-			// TODO: Bad API design: return data buffer and the code is returned in the same place. In worst case
-			//       the code is returned also when there is not enough funds to deploy the code.
-			output = createOutput
-		}
+		var ret []byte
+		saltUint256, _ := uint256.FromBig(salt)
+		ret, createAddr, gasLeftU, err = host.env.Create2(host.contract, input, gasU, value, saltUint256)
+		output = createOutput(ret, err)
 	default:
-		panic(fmt.Errorf("EVMC: Unknown call kind %d", kind))
+		// A buggy or newer VM may send a kind we don't know about, fail
+		// the call instead of bringing down the node.
+		evmcLogger().Error("EVMC: Unknown call kind", "kind", kind, "destination", destination, "depth", depth)
+		return nil, 0, common.Address{}, evmc.Failure
+	}
+
+	if maxOutput > 0 && len(output) > maxOutput {
+		evmcLogger().Warn("EVMC: Sub-call output exceeds the limit", "destination", destination, "size", len(output), "limit", maxOutput)
+		host.env.StateDB.RevertToSnapshot(snapshot.id)
+		host.interpreter.logs = host.interpreter.logs[:snapshot.logs]
+		output, gasLeftU, err = nil, 0, evmcOutputError
+	}
+
+	// Remember where the revert of the sub-call originated, in case the
+	// frame re-throws it.
+	host.subRevert, host.subCallbacks = nil, host.interpreter.callbacks
+	if err == ErrExecutionReverted {
+		host.subRevert = host.interpreter.revert
+		if host.subRevert == nil {
+			host.subRevert = &evmcRevert{depth: host.env.depth, data: output}
+		}
 	}
 
 	// Map errors.
@@ -294,14 +1021,44 @@ func (host *hostContext) Call(kind evmc.CallKind,
 		err = evmc.Failure
 	}
 
+	// Failing precompiles consume all the gas given, which is accounted too.
+	if kind != evmc.Create && kind != evmc.Create2 {
+		if _, ok := host.env.precompile(destination); ok {
+			host.interpreter.precompileGas += gasU - gasLeftU
+		}
+	}
+	if host.profile != nil {
+		host.profile.Call += gasU - gasLeftU
+	}
+	if meter := host.env.vmConfig.EVMCGasMeter; meter != nil {
+		callee := destination
+		if kind == evmc.Create || kind == evmc.Create2 {
+			callee = createAddr
+		}
+		meter(host.env.depth-1, host.contract.Address(), callee, gasU-gasLeftU)
+	}
 	gasLeft = int64(gasLeftU)
 	return output, gasLeft, createAddr, err
 }
 
+// createOutput returns the output of a contract creation as seen by the VM,
+// given what EVM.Create returned. The code returned by the init code is only
+// deployed, so the output is the revert data if the init code reverted and
+// empty otherwise.
+func createOutput(ret []byte, err error) []byte {
+	if err == ErrExecutionReverted {
+		return ret
+	}
+	return nil
+}
+
 // getRevision translates ChainConfig's HF block information into EVMC revision.
 func getRevision(env *EVM) evmc.Revision {
-	n := env.BlockNumber
-	conf := env.ChainConfig()
+	return revisionAt(env.ChainConfig(), env.BlockNumber)
+}
+
+// revisionAt returns the EVMC revision of the chain at block n.
+func revisionAt(conf ctypes.ChainConfigurator, n *big.Int) evmc.Revision {
 	switch {
 	// This is an example of choosing to use an "abstracted" idea
 	// about chain config, where I'm choosing to prioritize "indicative" features
@@ -326,19 +1083,173 @@ func getRevision(env *EVM) evmc.Revision {
 	}
 }
 
+// evmcRevisionReporter is implemented by VMs able to tell the latest revision
+// they support. The EVMC ABI has no such query, so VMs loaded from a shared
+// library don't report it.
+type evmcRevisionReporter interface {
+	MaxRevision() evmc.Revision
+}
+
+// Validate checks that the VM supports the revisions config reaches from the
+// given head block on. An unsupported head revision is an error, while a gap in
+// a later revision is only warned about, leaving time to upgrade the VM before
+// the fork. VMs not reporting their supported revisions are assumed to be fine.
+func (evm *EVMC) Validate(config ctypes.ChainConfigurator, head *big.Int) error {
+	reporter, ok := evm.instance.(evmcRevisionReporter)
+	if !ok {
+		evmcLogger().Debug("EVMC VM doesn't report its supported revisions")
+		return nil
+	}
+	var (
+		supported = reporter.MaxRevision()
+		current   = revisionAt(config, head)
+		latest    = revisionAt(config, new(big.Int).SetUint64(math.MaxUint64))
+	)
+	if current > supported {
+		return fmt.Errorf("EVMC VM supports revisions up to %d, chain head requires %d", supported, current)
+	}
+	if latest > supported {
+		evmcLogger().Warn("EVMC VM doesn't support upcoming revision", "supported", supported, "required", latest)
+	}
+	return nil
+}
+
+// EVMCResult is the outcome of an execution by an EVMC VM.
+type EVMCResult struct {
+	Output      []byte         // Returned data, or the revert data if the execution reverted
+	Err         error          // Execution error, nil on success
+	GasUsed     uint64         // Gas consumed by the execution
+	GasLeft     uint64         // Gas remaining after the execution
+	Refund      uint64         // Refund counter of the transaction after the execution
+	CallRefund  int64          // Change of the refund counter by the execution, zero on failure
+	Logs        []*types.Log   // Logs emitted by the EVMC executed frames, nil on failure
+	CreatedAddr common.Address // Address of the created contract on successful creation
+	CodeHash    common.Hash    // Hash of the code returned for deployment on successful creation
+	Steps       uint64         // Instructions executed by the frame, zero if not reported by the VM
+	RevertDepth int            // Depth of the frame the revert originated in, if reverted
+	Revision    evmc.Revision  // Revision the code was executed with
+
+	Callbacks     EVMCCallbackCounts // Host callbacks invoked by the frame, including its nested frames run by the same VM
+	PrecompileGas uint64             // Gas consumed by precompiled contracts called by the frame, including its nested frames run by the same VM
+}
+
+// evmcRevert records the frame a revert originated in, following it as it is
+// re-thrown by the calling frames.
+type evmcRevert struct {
+	depth int
+	data  []byte
+}
+
+// rethrows reports whether the frame reverting with the given data re-throws
+// the revert of its last sub-call, i.e. made no other host callback since.
+func (host *hostContext) rethrows(output []byte) bool {
+	return host.subRevert != nil && host.subCallbacks == host.interpreter.callbacks && bytes.Equal(host.subRevert.data, output)
+}
+
+// evmcStepCounter is implemented by VMs able to tell the number of
+// instructions executed by the frame run on the given host context. The
+// tracer of the EVMC ABI is deprecated and bound to the shared VM instance
+// rather than an execution, so VMs loaded from a shared library don't report
+// it.
+type evmcStepCounter interface {
+	Steps(host evmc.HostContext) uint64
+}
+
+// evmcReentrancyReporter is implemented by VMs telling whether they are
+// reentrant. VMs not implementing it, including all VMs loaded from a shared
+// library, are assumed to be, as the EVMC specification requires.
+type evmcReentrancyReporter interface {
+	Reentrant() bool
+}
+
+// evmcLock serializes the executions of non-reentrant VMs. It is taken by the
+// outermost frame of an EVM run by such a VM and held until that frame returns,
+// so the nested frames of any VM never wait on it, and EVMs calling across VMs
+// can't deadlock.
+var evmcLock sync.Mutex
+
+// sameEVMCVM reports whether a and b are the same VM. VMs that can't be
+// compared, like Go VMs holding functions, are told apart by type only.
+func sameEVMCVM(a, b evmcVM) bool {
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return false
+	}
+	if !reflect.TypeOf(a).Comparable() {
+		return true
+	}
+	return a == b
+}
+
 // Run implements Interpreter.Run().
 func (evm *EVMC) Run(contract *Contract, input []byte, readOnly bool) (ret []byte, err error) {
+	result := evm.RunEx(contract, input, readOnly)
+	return result.Output, result.Err
+}
+
+// RunEx runs the contract like Run, but returns the structured result of the
+// execution. Failed executions still report the gas used and, if reverted, the
+// revert data. With readOnly set the whole execution tree is write protected,
+// any state modification attempted by the VM fails with ErrWriteProtection.
+func (evm *EVMC) RunEx(contract *Contract, input []byte, readOnly bool) *EVMCResult {
 	evm.env.depth++
 	defer func() { evm.env.depth-- }()
 
-	// Don't bother with the execution if there's no code.
+	result := &EVMCResult{GasLeft: contract.Gas}
+
+	// All frames are accounted, including the ones failed or skipped before
+	// reaching the VM, which spend no time in it.
+	var start time.Time
+	if evm.stats != nil {
+		outermost := evm.active == 0
+		defer func() {
+			var elapsed time.Duration
+			if !start.IsZero() {
+				elapsed = time.Since(start)
+			}
+			evm.stats.record(outermost, result.GasUsed, elapsed, result.Err)
+		}()
+	}
+
+	// Don't bother with the execution if there's no code. For a creation
+	// with empty init code the account was already set up by the EVM, and
+	// the empty code is what gets deployed.
 	if len(contract.Code) == 0 {
-		return nil, nil
+		if contract.IsDeployment {
+			result.CreatedAddr, result.CodeHash = contract.Address(), emptyCodeHash
+		}
+		return result
+	}
+	// Non-reentrant VMs can't run frames nested in one of their own, which
+	// are failed, even if run through another interpreter, nor frames of
+	// concurrent executions, which are serialized.
+	if reporter, ok := evm.instance.(evmcReentrancyReporter); ok && !reporter.Reentrant() {
+		for _, vm := range evm.env.evmcActive {
+			if sameEVMCVM(vm, evm.instance) {
+				evmcLogger().Debug("EVMC VM reentered", "address", contract.Address(), "depth", evm.env.depth-1)
+				result.Err, result.GasUsed, result.GasLeft = evmcReentryError, contract.Gas, 0
+				contract.Gas = 0
+				return result
+			}
+		}
+		if len(evm.env.evmcActive) == 0 {
+			evmcLock.Lock()
+			defer evmcLock.Unlock()
+		}
+		evm.env.evmcActive = append(evm.env.evmcActive, evm.instance)
+		defer func() { evm.env.evmcActive = evm.env.evmcActive[:len(evm.env.evmcActive)-1] }()
 	}
+	evm.active++
+	evm.env.evmcFrames++
+	defer func() {
+		evm.active--
+		evm.env.evmcFrames--
+	}()
+
+	contract.Input = input
+	evm.revert = nil
 
 	kind := evmc.Call
-	if evm.env.StateDB.GetCodeSize(contract.Address()) == 0 {
-		// Guess if this is a CREATE.
+	if contract.IsDeployment {
 		kind = evmc.Create
 	}
 
@@ -349,9 +1260,145 @@ func (evm *EVMC) Run(contract *Contract, input []byte, readOnly bool) (ret []byt
 		defer func() { evm.readOnly = false }()
 	}
 
-	output, gasLeft, err := evm.instance.Execute(
-		&hostContext{evm.env, contract},
-		getRevision(evm.env),
+	// The timeout covers the whole execution, so only arm it for the
+	// outermost EVMC frame, which may be nested in native frames. The VM
+	// itself can't be interrupted, but aborting the EVM fails all sub-calls
+	// and native frames from there on.
+	var stopTimer func() bool
+	if timeout := evm.env.vmConfig.EVMCTimeout; timeout > 0 && evm.env.evmcFrames == 1 {
+		stopTimer = evmcAfterFunc(timeout, evm.env.Cancel)
+		defer stopTimer()
+	}
+
+	host := &hostContext{env: evm.env, interpreter: evm, contract: contract}
+	if evm.env.vmConfig.EVMCGasProfiling {
+		host.profile = &EVMCGasProfile{Depth: evm.env.depth - 1, Address: contract.Address()}
+		evm.profiles = append(evm.profiles, host.profile)
+	}
+	var (
+		startGas    = contract.Gas
+		budget      = contract.Gas
+		logs        = len(evm.logs)
+		startRefund = evm.env.StateDB.GetRefund()
+	)
+	// Simulations run with a high but finite gas budget, so the execution
+	// always terminates and reports the gas it really needs. At most the gas
+	// of the call is charged.
+	simulated := evm.env.depth == 1 && evm.env.vmConfig.EVMCSimulationGas > startGas
+	if simulated {
+		budget = evm.env.vmConfig.EVMCSimulationGas
+		if budget > math.MaxInt64 {
+			budget = math.MaxInt64
+		}
+		contract.Gas = budget
+	}
+	callbacks, precompileGas := evm.callbacks, evm.precompileGas
+	result.Revision = getRevision(evm.env)
+	start = time.Now()
+	output, gasLeft, err := evm.execute(host, result.Revision, kind, contract, input)
+
+	// Gas refunds are accumulated in the StateDB by the host callbacks
+	// (SetStorage, Selfdestruct), so just like for the native interpreter
+	// they reach the transaction finalizer without being returned here.
+	contract.Gas = uint64(gasLeft)
+
+	// A timer that can't be stopped anymore has fired, or is firing, and
+	// aborts the EVM, so the execution timed out even if the VM returned.
+	if stopTimer != nil && !stopTimer() {
+		contract.Gas = 0
+		output, err = nil, evmcTimeoutError
+	} else if host.writeViolation {
+		contract.Gas = 0
+		output, err = nil, ErrWriteProtection
+	} else if host.badSnapshot {
+		contract.Gas = 0
+		output, err = nil, evmcSnapshotError
+	} else if limit := evm.env.vmConfig.EVMCMaxOutputSize; limit > 0 && len(output) > limit {
+		contract.Gas = 0
+		output, err = nil, evmcOutputError
+	} else if err == evmc.Revert {
+		err = ErrExecutionReverted
+	} else if err == evmc.OutOfGas {
+		err = &ErrEVMCOutOfGas{available: budget}
+	} else if evmcError, ok := err.(evmc.Error); ok && evmcError.IsInternalError() {
+		if evmcPanicOnInternalError {
+			panic(evmcInternalPanic(fmt.Sprintf("EVMC VM internal error: %s", evmcError.Error())))
+		}
+		evmcLogger().Error("EVMC: VM internal error", "err", evmcError, "address", contract.Address(), "depth", evm.env.depth-1)
+		output, err = nil, fmt.Errorf("%s: %v", evmcModuleError, evmcError.Error())
+	}
+	// A simulation using more than the gas of the call fails, as the real
+	// call would have run out of gas.
+	if simulated && budget-contract.Gas > startGas && (err == nil || err == ErrExecutionReverted) {
+		output, err = nil, &ErrEVMCOutOfGas{available: startGas}
+	}
+	result.Output, result.Err = output, err
+
+	// A frame reverting with the revert data of its last sub-call, without
+	// interacting with the host after it returned, re-throws the revert.
+	// Otherwise the revert originates here.
+	if err == ErrExecutionReverted {
+		if host.rethrows(output) {
+			evm.revert = host.subRevert
+		} else {
+			evm.revert = &evmcRevert{depth: evm.env.depth - 1, data: output}
+		}
+		result.RevertDepth = evm.revert.depth
+	} else {
+		evm.revert = nil
+	}
+	result.GasUsed = budget - contract.Gas
+	if simulated {
+		contract.Gas = 0
+		if result.GasUsed < startGas {
+			contract.Gas = startGas - result.GasUsed
+		}
+	}
+	result.GasLeft = contract.Gas
+	result.Refund = evm.env.StateDB.GetRefund()
+	result.Callbacks = evm.callbacks.sub(callbacks)
+	result.PrecompileGas = evm.precompileGas - precompileGas
+	if counter, ok := evm.instance.(evmcStepCounter); ok {
+		result.Steps = counter.Steps(host)
+	}
+
+	// The logs of a failed frame are reverted along with its state changes.
+	if err != nil {
+		evm.logs = evm.logs[:logs]
+	} else {
+		host.flushLogs()
+		if len(evm.logs) > logs {
+			result.Logs = append([]*types.Log(nil), evm.logs[logs:]...)
+		}
+		// Refunds may be taken back too, e.g. by restoring a cleared slot.
+		result.CallRefund = int64(result.Refund) - int64(startRefund)
+		if kind == evmc.Create {
+			result.CreatedAddr = contract.Address()
+			result.CodeHash = crypto.Keccak256Hash(output)
+		}
+	}
+	return result
+}
+
+// execute runs the contract code in the VM. A panic of the VM or the binding is
+// recovered and reported as evmcPanicError consuming all gas, so a single bad
+// contract can't take down block processing. Panics of the host callbacks,
+// including the nested frames, are faults of the node and go through.
+func (evm *EVMC) execute(host *hostContext, rev evmc.Revision, kind evmc.CallKind, contract *Contract, input []byte) (output []byte, gasLeft int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Fail-fast panics of nested frames are meant to go through.
+			switch r.(type) {
+			case *evmcHostPanic, evmcInternalPanic:
+				panic(r)
+			}
+			evmcLogger().Error("EVMC VM panicked", "address", contract.Address(), "err", r, "stack", string(debug.Stack()))
+			output, gasLeft, err = nil, 0, evmcPanicError
+		}
+	}()
+	return evm.instance.Execute(
+		host,
+		rev,
 		kind,
 		evm.readOnly,
 		evm.env.depth-1,
@@ -359,29 +1406,28 @@ func (evm *EVMC) Run(contract *Contract, input []byte, readOnly bool) (ret []byt
 		contract.Address(),
 		contract.Caller(),
 		input,
-		common.BigToHash(contract.Value()),
+		bigToHash(contract.Value()),
 		contract.Code,
 		common.Hash{})
+}
 
-	contract.Gas = uint64(gasLeft)
-
-	if err == evmc.Revert {
-		err = ErrExecutionReverted
-	} else if evmcError, ok := err.(evmc.Error); ok && evmcError.IsInternalError() {
-		//panic(fmt.Sprintf("EVMC VM internal error: %s", evmcError.Error()))
-		fmt.Println(fmt.Errorf("%s: %v (%v)", evmcModuleError, evmcError.Error(), err.Error()))
-		return nil, fmt.Errorf("%s: %v", evmcModuleError, evmcError.Error())
-	}
-
-	return output, err
+// GasProfiles returns the gas profiles of the frames executed so far, in the
+// order they were entered. Profiles are only collected if the EVMCGasProfiling
+// option is enabled in the VM config.
+func (evm *EVMC) GasProfiles() []*EVMCGasProfile {
+	return evm.profiles
 }
 
 // CanRun implements Interpreter.CanRun().
 func (evm *EVMC) CanRun(code []byte) bool {
 	required := evmc.CapabilityEVM1
-	wasmPreamble := []byte("\x00asm")
-	if bytes.HasPrefix(code, wasmPreamble) {
+	if isWasmCode(code) {
 		required = evmc.CapabilityEWASM
 	}
 	return evm.cap == required
 }
+
+// isWasmCode reports whether the code starts with the WebAssembly preamble.
+func isWasmCode(code []byte) bool {
+	return bytes.HasPrefix(code, []byte("\x00asm"))
+}
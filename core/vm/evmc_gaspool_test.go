@@ -0,0 +1,101 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that transactions executed through EVMC draw their gas from the block
+// gas pool like natively executed ones: the gas limit is reserved up front, the
+// gas left over is given back, and a transaction exceeding the gas remaining in
+// the block is rejected without being executed.
+func TestEVMCBlockGasPool(t *testing.T) {
+	restore := vm.UseMiniEVMC()
+	defer restore()
+
+	var (
+		sender   = common.BytesToAddress([]byte("sender"))
+		coinbase = common.BytesToAddress([]byte("coinbase"))
+		contract = common.BytesToAddress([]byte{0x42})
+		// PUSH1 1 PUSH1 <slot> SSTORE STOP, run as EVM bytecode by both the
+		// native interpreter and the Go VM behind EVMC.
+		store = func(slot byte) []byte { return []byte{0x60, 0x01, 0x60, slot, 0x55, 0x00} }
+	)
+	tests := []struct {
+		name   string
+		config vm.Config
+		used   uint64 // gas used by a transaction storing a slot
+	}{
+		{"native", vm.Config{}, 41006},
+		{"evmc", vm.Config{EVMInterpreter: "mini"}, 21004}, // the Go VM charges 1 gas per instruction
+	}
+	for _, tt := range tests {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.AddBalance(sender, big.NewInt(1e18))
+		header := &types.Header{Number: big.NewInt(1), GasLimit: 150000, Difficulty: big.NewInt(1)}
+		gp := new(core.GasPool).AddGas(header.GasLimit)
+
+		apply := func(nonce uint64, slot byte, gas uint64) (*core.ExecutionResult, error) {
+			statedb.SetCode(contract, store(slot))
+			msg := types.NewMessage(sender, &contract, nonce, new(big.Int), gas, big.NewInt(1), nil, true)
+			evm := vm.NewEVM(core.NewEVMContext(msg, header, nil, &coinbase), statedb, params.AllEthashProtocolChanges, tt.config)
+			return core.ApplyMessage(evm, msg, gp)
+		}
+		// The first transaction reserves 100000 gas, leaving 50000 in the block
+		// while it runs, and gives back what it didn't use.
+		result, err := apply(0, 1, 100000)
+		if err != nil || result.Failed() {
+			t.Fatalf("%s: first transaction failed: %v", tt.name, err)
+		}
+		if result.UsedGas != tt.used {
+			t.Fatalf("%s: gas used mismatch: have %d, want %d", tt.name, result.UsedGas, tt.used)
+		}
+		if have, want := gp.Gas(), header.GasLimit-tt.used; have != want {
+			t.Fatalf("%s: gas pool after first transaction: have %d, want %d", tt.name, have, want)
+		}
+		// The second transaction only fits thanks to the gas given back.
+		remaining := gp.Gas()
+		if result, err = apply(1, 2, remaining); err != nil || result.Failed() {
+			t.Fatalf("%s: second transaction failed: %v", tt.name, err)
+		}
+		if have, want := gp.Gas(), remaining-tt.used; have != want {
+			t.Fatalf("%s: gas pool after second transaction: have %d, want %d", tt.name, have, want)
+		}
+		// The third transaction exceeds the gas left in the block.
+		if _, err = apply(2, 3, gp.Gas()+1); err != core.ErrGasLimitReached {
+			t.Errorf("%s: oversized transaction error mismatch: have %v, want %v", tt.name, err, core.ErrGasLimitReached)
+		}
+		if nonce := statedb.GetNonce(sender); nonce != 2 {
+			t.Errorf("%s: sender nonce mismatch: have %d, want 2", tt.name, nonce)
+		}
+		for slot, want := range []common.Hash{{}, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)), {}} {
+			if have := statedb.GetState(contract, common.BigToHash(big.NewInt(int64(slot)))); have != want {
+				t.Errorf("%s: slot %d mismatch: have %x, want %x", tt.name, slot, have, want)
+			}
+		}
+	}
+}
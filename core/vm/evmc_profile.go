@@ -0,0 +1,256 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/evmc/bindings/go/evmc"
+	"github.com/ethereum/go-ethereum/params/vars"
+)
+
+// EVMCGasProfile holds the gas attributed to the host operations performed by
+// a single EVMC execution frame, grouped by operation class. The gas is derived
+// from the protocol rules of the executed revision, as the VM doesn't report
+// what it charged.
+type EVMCGasProfile struct {
+	Depth   int            // Call depth of the frame
+	Address common.Address // Address of the executing contract
+
+	Storage uint64 // SLOAD and SSTORE
+	Call    uint64 // Gas consumed by sub-calls and creations, including their nested frames
+	Account uint64 // BALANCE, SELFBALANCE, EXTCODESIZE, EXTCODEHASH, EXTCODECOPY and SELFDESTRUCT
+}
+
+// EVMCCallbackCounts holds the number of invocations of each host callback by
+// EVMC VMs, to spot executions crossing the cgo boundary excessively. GetCode
+// includes code slice reads.
+type EVMCCallbackCounts struct {
+	AccountExists uint64
+	GetStorage    uint64
+	SetStorage    uint64
+	GetBalance    uint64
+	GetCodeSize   uint64
+	GetCodeHash   uint64
+	GetCode       uint64
+	Selfdestruct  uint64
+	GetTxContext  uint64
+	GetBlockHash  uint64
+	EmitLog       uint64
+	Call          uint64
+
+	// Callbacks of the optional host extensions
+	IsPrecompile     uint64
+	GetInputSize     uint64
+	GetAddress       uint64
+	GetCaller        uint64
+	GetOriginNonce   uint64
+	GetCodeByHash    uint64
+	Snapshot         uint64
+	RevertToSnapshot uint64
+}
+
+// sub returns the invocations counted in c since the counts in base were taken.
+func (c EVMCCallbackCounts) sub(base EVMCCallbackCounts) EVMCCallbackCounts {
+	return EVMCCallbackCounts{
+		AccountExists: c.AccountExists - base.AccountExists,
+		GetStorage:    c.GetStorage - base.GetStorage,
+		SetStorage:    c.SetStorage - base.SetStorage,
+		GetBalance:    c.GetBalance - base.GetBalance,
+		GetCodeSize:   c.GetCodeSize - base.GetCodeSize,
+		GetCodeHash:   c.GetCodeHash - base.GetCodeHash,
+		GetCode:       c.GetCode - base.GetCode,
+		Selfdestruct:  c.Selfdestruct - base.Selfdestruct,
+		GetTxContext:  c.GetTxContext - base.GetTxContext,
+		GetBlockHash:  c.GetBlockHash - base.GetBlockHash,
+		EmitLog:       c.EmitLog - base.EmitLog,
+		Call:          c.Call - base.Call,
+
+		IsPrecompile:     c.IsPrecompile - base.IsPrecompile,
+		GetInputSize:     c.GetInputSize - base.GetInputSize,
+		GetAddress:       c.GetAddress - base.GetAddress,
+		GetCaller:        c.GetCaller - base.GetCaller,
+		GetOriginNonce:   c.GetOriginNonce - base.GetOriginNonce,
+		GetCodeByHash:    c.GetCodeByHash - base.GetCodeByHash,
+		Snapshot:         c.Snapshot - base.Snapshot,
+		RevertToSnapshot: c.RevertToSnapshot - base.RevertToSnapshot,
+	}
+}
+
+// EVMCGasMeterFunc is called after every sub-call or creation performed through
+// the EVMC host, with the call depth and address of the calling frame, the
+// address of the callee and the gas consumed by the sub-call, including its
+// nested frames. Nested sub-calls are reported before their parents.
+type EVMCGasMeterFunc func(depth int, caller common.Address, callee common.Address, gasUsed uint64)
+
+// sloadGas returns the gas cost of SLOAD in the current revision.
+func sloadGas(env *EVM) uint64 {
+	switch {
+	case env.ChainConfig().IsEnabled(env.ChainConfig().GetEIP1884Transition, env.BlockNumber):
+		return vars.SloadGasEIP1884
+	case env.ChainConfig().IsEnabled(env.ChainConfig().GetEIP150Transition, env.BlockNumber):
+		return vars.SloadGasEIP150
+	default:
+		return vars.SloadGasFrontier
+	}
+}
+
+// sstoreGas returns the gas cost of an SSTORE which resulted in the given
+// storage status in the current revision.
+func sstoreGas(env *EVM, status evmc.StorageStatus) uint64 {
+	conf := env.ChainConfig()
+	if conf.IsEnabled(conf.GetEIP2200Transition, env.BlockNumber) && conf.IsEnabled(conf.GetEIP1884Transition, env.BlockNumber) {
+		switch status {
+		case evmc.StorageAdded:
+			return vars.SstoreSetGasEIP2200
+		case evmc.StorageModified, evmc.StorageDeleted:
+			return vars.SstoreResetGasEIP2200
+		default:
+			return vars.SloadGasEIP2200
+		}
+	}
+	if status == evmc.StorageAdded {
+		return vars.SstoreSetGas
+	}
+	return vars.SstoreResetGas
+}
+
+// accountAccessGas returns the gas cost of BALANCE (balance set), or of
+// EXTCODESIZE and EXTCODECOPY otherwise, in the current revision.
+func accountAccessGas(env *EVM, balance bool) uint64 {
+	conf := env.ChainConfig()
+	switch {
+	case balance && conf.IsEnabled(conf.GetEIP1884Transition, env.BlockNumber):
+		return vars.BalanceGasEIP1884
+	case balance && conf.IsEnabled(conf.GetEIP150Transition, env.BlockNumber):
+		return vars.BalanceGasEIP150
+	case balance:
+		return vars.BalanceGasFrontier
+	case conf.IsEnabled(conf.GetEIP150Transition, env.BlockNumber):
+		return vars.ExtcodeSizeGasEIP150
+	default:
+		return vars.ExtcodeSizeGasFrontier
+	}
+}
+
+// balanceGas returns the gas cost of a balance read by the VM. VMs read their
+// own balance for SELFBALANCE, much cheaper than BALANCE, so such reads are
+// taken as SELFBALANCE once it is available.
+func balanceGas(env *EVM, self bool) uint64 {
+	conf := env.ChainConfig()
+	if self && (conf.IsEnabled(conf.GetEIP1884Transition, env.BlockNumber) || conf.IsEnabled(conf.GetECIP1080Transition, env.BlockNumber)) {
+		return GasFastStep
+	}
+	return accountAccessGas(env, true)
+}
+
+// extcodeHashGas returns the gas cost of EXTCODEHASH in the current revision.
+func extcodeHashGas(env *EVM) uint64 {
+	if env.ChainConfig().IsEnabled(env.ChainConfig().GetEIP1884Transition, env.BlockNumber) {
+		return vars.ExtcodeHashGasEIP1884
+	}
+	return vars.ExtcodeHashGasConstantinople
+}
+
+// selfdestructGas returns the base gas cost of SELFDESTRUCT in the current revision.
+func selfdestructGas(env *EVM) uint64 {
+	if env.ChainConfig().IsEnabled(env.ChainConfig().GetEIP150Transition, env.BlockNumber) {
+		return vars.SelfdestructGasEIP150
+	}
+	return 0
+}
+
+// EVMCStats holds the cumulative execution statistics of an EVMC VM. Every
+// frame run on the VM is counted, but Gas and Duration only cover the outermost
+// ones, as those include the gas and time of their nested frames.
+type EVMCStats struct {
+	Executions uint64        // Frames executed
+	Gas        uint64        // Gas used by the outermost frames
+	Duration   time.Duration // Time spent in the outermost frames
+	Outermost  uint64        // Outermost frames executed
+
+	Reverts  uint64 // Frames reverted
+	OutOfGas uint64 // Frames run out of gas
+	Failures uint64 // Frames failed otherwise, including VM internal errors
+}
+
+// AverageDuration returns the mean time spent in the outermost frames.
+func (s EVMCStats) AverageDuration() time.Duration {
+	if s.Outermost == 0 {
+		return 0
+	}
+	return s.Duration / time.Duration(s.Outermost)
+}
+
+// evmcStats accumulates the execution statistics of an EVMC VM, which is shared
+// by all concurrent executions, so the counters are updated atomically.
+type evmcStats struct {
+	executions uint64
+	gas        uint64
+	duration   uint64
+	outermost  uint64
+	reverts    uint64
+	outOfGas   uint64
+	failures   uint64
+}
+
+// EVMCStatistics returns the execution statistics of the loaded EVM1 and Ewasm
+// VMs since they were loaded, or zero statistics for the VMs not loaded.
+func EVMCStatistics() (evm1 EVMCStats, ewasm EVMCStats) {
+	if evmModule != nil {
+		evm1 = evmModule.stats.snapshot()
+	}
+	if ewasmModule != nil {
+		ewasm = ewasmModule.stats.snapshot()
+	}
+	return evm1, ewasm
+}
+
+// record accounts a finished frame, with the gas and duration of outermost ones.
+func (s *evmcStats) record(outermost bool, gasUsed uint64, elapsed time.Duration, err error) {
+	atomic.AddUint64(&s.executions, 1)
+	if outermost {
+		atomic.AddUint64(&s.outermost, 1)
+		atomic.AddUint64(&s.gas, gasUsed)
+		atomic.AddUint64(&s.duration, uint64(elapsed))
+	}
+	switch {
+	case err == nil:
+	case err == ErrExecutionReverted:
+		atomic.AddUint64(&s.reverts, 1)
+	case errors.Is(err, ErrOutOfGas):
+		atomic.AddUint64(&s.outOfGas, 1)
+	default:
+		atomic.AddUint64(&s.failures, 1)
+	}
+}
+
+// snapshot returns the statistics accumulated so far.
+func (s *evmcStats) snapshot() EVMCStats {
+	return EVMCStats{
+		Executions: atomic.LoadUint64(&s.executions),
+		Gas:        atomic.LoadUint64(&s.gas),
+		Duration:   time.Duration(atomic.LoadUint64(&s.duration)),
+		Outermost:  atomic.LoadUint64(&s.outermost),
+		Reverts:    atomic.LoadUint64(&s.reverts),
+		OutOfGas:   atomic.LoadUint64(&s.outOfGas),
+		Failures:   atomic.LoadUint64(&s.failures),
+	}
+}
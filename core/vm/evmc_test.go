@@ -0,0 +1,3033 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/evmc/bindings/go/evmc"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/types/coregeth"
+	"github.com/ethereum/go-ethereum/params/types/ctypes"
+	"github.com/ethereum/go-ethereum/params/vars"
+	"github.com/holiman/uint256"
+)
+
+func testCanTransfer(db StateDB, addr common.Address, amount *big.Int) bool {
+	return db.GetBalance(addr).Cmp(amount) >= 0
+}
+
+func testTransfer(db StateDB, sender, recipient common.Address, amount *big.Int) {
+	db.SubBalance(sender, amount)
+	db.AddBalance(recipient, amount)
+}
+
+// evmcTestAddress is the address of the contract executed by the tests.
+var evmcTestAddress = common.BytesToAddress([]byte("contract"))
+
+// newTestHost returns a host context for a frame of the test contract, with
+// all protocol changes enabled.
+func newTestHost() *hostContext {
+	return newTestHostContext(params.AllEthashProtocolChanges, 0, evmcTestAddress)
+}
+
+// newTestHostContext creates an EVMC host context backed by a fresh in-memory
+// state, executing on behalf of the contract at address.
+func newTestHostContext(config ctypes.ChainConfigurator, blockNumber uint64, address common.Address) *hostContext {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+
+	vmctx := Context{
+		CanTransfer: testCanTransfer,
+		Transfer:    testTransfer,
+		GetHash:     func(n uint64) common.Hash { return common.BigToHash(new(big.Int).SetUint64(n)) },
+		BlockNumber: new(big.Int).SetUint64(blockNumber),
+		Time:        new(big.Int),
+		Difficulty:  new(big.Int),
+		GasPrice:    new(big.Int),
+	}
+	env := NewEVM(vmctx, statedb, config, Config{})
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(address), new(big.Int), 0)
+	interpreter := &EVMC{env: env, cap: evmc.CapabilityEVM1}
+	return &hostContext{env: env, interpreter: interpreter, contract: contract}
+}
+
+func TestEVMCHostGetCodeSlice(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		code    = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		host    = newTestHost()
+	)
+	host.env.StateDB.SetCode(address, code)
+
+	tests := []struct {
+		offset, size uint64
+		want         []byte
+	}{
+		{0, 8, code},                     // whole code
+		{2, 3, []byte{0x03, 0x04, 0x05}}, // in range
+		{6, 4, []byte{0x07, 0x08}},       // straddling the end
+		{8, 2, nil},                      // right at the end
+		{100, 3, nil},                    // beyond the end
+		{^uint64(0), 2, nil},             // offset overflow
+		{2, ^uint64(0), code[2:]},        // size overflow
+		{3, 0, nil},                      // empty window
+	}
+	for i, tt := range tests {
+		if have := host.GetCodeSlice(address, tt.offset, tt.size); !bytes.Equal(have, tt.want) {
+			t.Errorf("test %d: code slice mismatch: have %x, want %x", i, have, tt.want)
+		}
+	}
+	// Reading code of a non-existent account yields nothing, left for the VM
+	// to pad.
+	if have := host.GetCodeSlice(common.Address{0xff}, 0, 4); len(have) != 0 {
+		t.Errorf("missing account: code slice mismatch: have %x, want none", have)
+	}
+}
+
+func TestEVMCHostCallUnknownKind(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		host    = newTestHost()
+	)
+	output, gasLeft, createAddr, err := host.Call(evmc.CallKind(99), common.Address{0x01}, address,
+		new(big.Int), nil, 100000, 1, false, new(big.Int))
+	if err != evmc.Failure {
+		t.Errorf("error mismatch: have %v, want %v", err, evmc.Failure)
+	}
+	if output != nil || gasLeft != 0 || createAddr != (common.Address{}) {
+		t.Errorf("unexpected result: output %x, gas left %d, create address %x", output, gasLeft, createAddr)
+	}
+}
+
+func TestEVMCHostStaticCreate(t *testing.T) {
+	// PUSH1 0x01 PUSH1 0x00 SSTORE
+	initCode := []byte{0x60, 0x01, 0x60, 0x00, 0x55}
+
+	for _, kind := range []evmc.CallKind{evmc.Create, evmc.Create2} {
+		var (
+			address = evmcTestAddress
+			host    = newTestHost()
+			statedb = host.env.StateDB
+		)
+		statedb.SetNonce(address, 1)
+		root := statedb.(*state.StateDB).IntermediateRoot(false)
+
+		_, gasLeft, createAddr, err := host.Call(kind, common.Address{}, address,
+			new(big.Int), initCode, 100000, 1, true, new(big.Int))
+		if err != evmc.Failure {
+			t.Errorf("kind %d: error mismatch: have %v, want %v", kind, err, evmc.Failure)
+		}
+		if gasLeft != 0 || createAddr != (common.Address{}) {
+			t.Errorf("kind %d: unexpected result: gas left %d, create address %x", kind, gasLeft, createAddr)
+		}
+		if !host.writeViolation {
+			t.Errorf("kind %d: write protection violation not flagged", kind)
+		}
+		if nonce := statedb.GetNonce(address); nonce != 1 {
+			t.Errorf("kind %d: creator nonce changed: have %d, want 1", kind, nonce)
+		}
+		if have := statedb.(*state.StateDB).IntermediateRoot(false); have != root {
+			t.Errorf("kind %d: state modified: have root %x, want %x", kind, have, root)
+		}
+	}
+}
+
+// Tests that the gas refunds accumulated by the EVMC host for a sequence of
+// SSTOREs match the ones of the native interpreter.
+func TestEVMCHostSetStorageRefund(t *testing.T) {
+	for i, tt := range eip2200Tests {
+		if tt.failure != nil {
+			continue
+		}
+		var (
+			address = evmcTestAddress
+			host    = newTestHost()
+			statedb = host.env.StateDB.(*state.StateDB)
+		)
+		statedb.SetState(address, common.Hash{}, common.BytesToHash([]byte{tt.original}))
+		statedb.Finalise(false) // Push the state into the "original" slot, keeping the codeless contract
+
+		// The test inputs are sequences of PUSH1 value PUSH1 0 SSTORE.
+		code := hexutil.MustDecode(tt.input)
+		for pc := 0; pc+5 <= len(code); pc += 5 {
+			host.SetStorage(address, common.Hash{}, common.BytesToHash(code[pc+1:pc+2]))
+		}
+		if refund := statedb.GetRefund(); refund != tt.refund {
+			t.Errorf("test %d: gas refund mismatch: have %v, want %v", i, refund, tt.refund)
+		}
+	}
+}
+
+// Tests that refunds of nested frames aggregate in the StateDB and those of
+// reverted frames are dropped along with their state changes.
+func TestEVMCHostNestedRefund(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		host    = newTestHost()
+		statedb = host.env.StateDB.(*state.StateDB)
+		one     = common.BytesToHash([]byte{1})
+		two     = common.BytesToHash([]byte{2})
+	)
+	statedb.SetState(address, common.Hash{}, one)
+	statedb.SetState(address, two, one)
+	statedb.Finalise(false)
+
+	host.SetStorage(address, common.Hash{}, common.Hash{}) // clear, outer frame
+
+	snapshot := statedb.Snapshot()
+	host.SetStorage(address, two, common.Hash{}) // clear, inner frame
+	if refund := statedb.GetRefund(); refund != 2*vars.NetSstoreClearRefund {
+		t.Fatalf("nested refund mismatch: have %d, want %d", refund, 2*vars.NetSstoreClearRefund)
+	}
+	statedb.RevertToSnapshot(snapshot)
+	if refund := statedb.GetRefund(); refund != vars.NetSstoreClearRefund {
+		t.Fatalf("reverted refund mismatch: have %d, want %d", refund, vars.NetSstoreClearRefund)
+	}
+}
+
+func TestEVMCABIVersionCheck(t *testing.T) {
+	tests := []struct {
+		version int
+		ok      bool
+	}{
+		{evmc.ABIVersion, true},
+		{evmc.ABIVersion - 1, false},
+		{9, false},
+		{10, false},
+		{11, false},
+		{0, false},
+		{-1, false},
+	}
+	for _, tt := range tests {
+		if err := checkEVMCABIVersion(tt.version); (err == nil) != tt.ok {
+			t.Errorf("ABI version %d: check mismatch: have %v, want ok %v", tt.version, err, tt.ok)
+		}
+	}
+	// VMs built against newer ABIs are told apart from outdated ones.
+	if err := checkEVMCABIVersion(evmc.ABIVersion + 1); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("newer ABI version error mismatch: have %v", err)
+	}
+	if evm1, ewasm := EVMCABIVersions(); evm1 != 0 || ewasm != 0 {
+		t.Errorf("ABI versions reported without loaded VMs: %d, %d", evm1, ewasm)
+	}
+}
+
+func TestEVMCHostGasProfile(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte("callee"))
+		host    = newTestHost()
+		statedb = host.env.StateDB
+	)
+	// The callee is run by the native interpreter: PUSH1 1 PUSH1 0 SSTORE
+	statedb.SetCode(callee, []byte{0x60, 0x01, 0x60, 0x00, 0x55})
+	host.profile = &EVMCGasProfile{Address: address}
+
+	host.GetStorage(address, common.Hash{})
+	host.SetStorage(address, common.Hash{}, common.BytesToHash([]byte{1}))
+	host.GetBalance(callee)
+	host.GetBalance(address) // SELFBALANCE
+	host.GetCodeSize(callee)
+	_, gasLeft, _, err := host.Call(evmc.Call, callee, address, new(big.Int), nil, 100000, 1, false, new(big.Int))
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	want := EVMCGasProfile{
+		Address: address,
+		Storage: vars.SloadGasEIP2200 + vars.SstoreSetGasEIP2200,
+		Account: vars.BalanceGasEIP1884 + GasFastStep + vars.ExtcodeSizeGasEIP150,
+		Call:    uint64(100000 - gasLeft),
+	}
+	if *host.profile != want {
+		t.Errorf("profile mismatch: have %+v, want %+v", *host.profile, want)
+	}
+	// The SSTORE of the nested frame must only be accounted for in the
+	// call bucket of the caller.
+	if want.Call != 2*GasFastestStep+vars.SstoreSetGasEIP2200 {
+		t.Errorf("call gas mismatch: have %d, want %d", want.Call, 2*GasFastestStep+vars.SstoreSetGasEIP2200)
+	}
+	// Without SELFBALANCE the own balance is read by BALANCE.
+	host = newTestHostContext(params.MainnetChainConfig, 4370000, address)
+	host.profile = &EVMCGasProfile{Address: address}
+	host.GetBalance(address)
+	if host.profile.Account != vars.BalanceGasEIP150 {
+		t.Errorf("pre-Istanbul own balance gas mismatch: have %d, want %d", host.profile.Account, vars.BalanceGasEIP150)
+	}
+}
+
+// Tests that the gas left reported to the VM after a sub-call matches the gas
+// the native interpreter would get back, so GAS reads after a CALL agree.
+func TestEVMCHostCallGasLeft(t *testing.T) {
+	var (
+		address   = evmcTestAddress
+		callee    = common.BytesToAddress([]byte("callee"))
+		available = uint64(100000)
+		forwarded = available - available/64 // all but one 64th (EIP-150)
+	)
+	// GAS POP STOP
+	code := []byte{byte(GAS), byte(POP), byte(STOP)}
+
+	host := newTestHost()
+	host.env.StateDB.SetCode(callee, code)
+	_, gasLeft, _, err := host.Call(evmc.Call, callee, address, new(big.Int), nil, int64(forwarded), 1, false, new(big.Int))
+	if err != nil {
+		t.Fatalf("host call failed: %v", err)
+	}
+	native := newTestHost()
+	native.env.StateDB.SetCode(callee, code)
+	_, leftOver, err := native.env.Call(AccountRef(address), callee, nil, forwarded, new(big.Int))
+	if err != nil {
+		t.Fatalf("native call failed: %v", err)
+	}
+	if uint64(gasLeft) != leftOver {
+		t.Errorf("gas left mismatch: have %d, want %d", gasLeft, leftOver)
+	}
+	if want := forwarded - GasQuickStep - GasQuickStep; uint64(gasLeft) != want {
+		t.Errorf("gas left mismatch: have %d, want %d", gasLeft, want)
+	}
+}
+
+// stubEVMCVM is an EVMC VM running a Go function instead of the code.
+type stubEVMCVM func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error)
+
+func (vm stubEVMCVM) Execute(host evmc.HostContext, rev evmc.Revision,
+	kind evmc.CallKind, static bool, depth int, gas int64,
+	destination common.Address, sender common.Address, input []byte, value common.Hash,
+	code []byte, create2Salt common.Hash) ([]byte, int64, error) {
+	return vm(host, kind, static, depth, gas)
+}
+
+// newTestEVMC creates an EVMC interpreter driving vm on top of a host context
+// created by newTestHostContext, along with a contract to run at address.
+func newTestEVMC(vm evmcVM, address common.Address, gas uint64) (*EVMC, *Contract) {
+	host := newTestHostContext(params.AllEthashProtocolChanges, 0, address)
+	interpreter := host.interpreter
+	interpreter.instance = vm
+	host.env.interpreters = []Interpreter{interpreter}
+	host.env.interpreter = interpreter
+
+	code := []byte{byte(STOP)}
+	host.env.StateDB.SetCode(address, code)
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(address), new(big.Int), gas)
+	contract.SetCallCode(&address, crypto.Keccak256Hash(code), code)
+	return interpreter, contract
+}
+
+// newStubEVMC returns an interpreter running the given VM, and a contract of the
+// test address with the given gas.
+func newStubEVMC(vm evmcVM, gas uint64) (*EVMC, *Contract) {
+	return newTestEVMC(vm, evmcTestAddress, gas)
+}
+
+func TestEVMCTimeout(t *testing.T) {
+	// The timer fires when told to by the VM, or when stopped after the VM
+	// returned, racing with the end of the execution.
+	var (
+		fire  func()
+		fired bool
+		late  bool
+		armed int
+	)
+	defer func(afterFunc func(time.Duration, func()) func() bool) { evmcAfterFunc = afterFunc }(evmcAfterFunc)
+	evmcAfterFunc = func(d time.Duration, f func()) func() bool {
+		armed++
+		fired = false
+		fire = func() { fired = true; f() }
+		return func() bool {
+			if late && !fired {
+				fire()
+				return false
+			}
+			return !fired
+		}
+	}
+	tests := []struct {
+		name   string
+		during bool // whether the timer fires during the execution
+		late   bool // whether the timer fires after the VM returned
+		nested bool // whether the EVMC frames are nested in a native frame
+		want   error
+	}{
+		{"under the limit", false, false, false, nil},
+		{"exceeded", true, false, false, evmcTimeoutError},
+		{"exceeded on return", false, true, false, evmcTimeoutError},
+		{"under the limit below native", false, false, true, nil},
+		{"exceeded below native", true, false, true, evmcTimeoutError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		late, armed = tt.late, 0
+		var subcallErr error
+		// The outermost EVMC frame calls itself once.
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			if host.(evmc.FrameGetter).GetCaller() == evmcTestAddress {
+				return nil, gas, nil
+			}
+			if tt.during {
+				fire()
+			}
+			_, _, _, subcallErr = host.Call(evmc.Call, evmcTestAddress, evmcTestAddress, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+			return nil, gas, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 100000)
+		interpreter.env.vmConfig.EVMCTimeout = 10 * time.Millisecond
+		if tt.nested {
+			interpreter.env.depth = 1
+		}
+		if _, err := interpreter.Run(contract, nil, false); err != tt.want {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.name, err, tt.want)
+		}
+		// The timeout is armed once, by the outermost EVMC frame.
+		if armed != 1 {
+			t.Errorf("%s: armed timer count mismatch: have %d, want 1", tt.name, armed)
+		}
+		// Once timed out, the EVM is aborted for good, and a run isn't
+		// reported as timed out without it.
+		if cancelled := interpreter.env.Cancelled(); cancelled != (tt.want != nil) {
+			t.Errorf("%s: EVM cancellation mismatch: have %v, want %v", tt.name, cancelled, tt.want != nil)
+		}
+		if tt.want != nil && contract.Gas != 0 {
+			t.Errorf("%s: gas left after timeout: have %d, want 0", tt.name, contract.Gas)
+		}
+		switch {
+		case tt.during && subcallErr != evmc.Failure:
+			t.Errorf("%s: sub-call error mismatch after timeout: have %v, want %v", tt.name, subcallErr, evmc.Failure)
+		case !tt.during && subcallErr != nil:
+			t.Errorf("%s: sub-call failed before the timeout: %v", tt.name, subcallErr)
+		}
+	}
+}
+
+// Tests that with both an EVM1 and an Ewasm VM loaded, each contract is
+// dispatched to the VM matching its code, also across calls between them.
+func TestEVMCMixedDispatch(t *testing.T) {
+	var (
+		evmAddr  = common.BytesToAddress([]byte("evm1"))
+		wasmAddr = common.BytesToAddress([]byte("ewasm"))
+		wasmCode = []byte("\x00asm\x01\x00\x00\x00")
+		trace    []string
+	)
+	evm1 := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		trace = append(trace, "evm1")
+		_, gasLeft, _, err := host.Call(evmc.Call, wasmAddr, evmAddr, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		return nil, gasLeft, err
+	})
+	ewasm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		trace = append(trace, "ewasm")
+		return nil, gas, nil
+	})
+	interpreter, contract := newTestEVMC(evm1, evmAddr, 100000)
+	env := interpreter.env
+	env.interpreters = []Interpreter{
+		&EVMC{instance: ewasm, env: env, cap: evmc.CapabilityEWASM},
+		interpreter,
+	}
+	env.StateDB.SetCode(wasmAddr, wasmCode)
+
+	if _, err := run(env, contract, nil, false); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if len(trace) != 2 || trace[0] != "evm1" || trace[1] != "ewasm" {
+		t.Errorf("dispatch mismatch: have %v, want [evm1 ewasm]", trace)
+	}
+	if env.interpreter != interpreter {
+		t.Errorf("current interpreter not restored after the call")
+	}
+}
+
+// Tests that a successful CREATE returns no output, as the returned code is
+// deployed, while a reverted one returns the revert data.
+func TestEVMCHostCreateOutput(t *testing.T) {
+	tests := []struct {
+		initCode []byte
+		output   []byte
+		err      error
+		deployed []byte
+	}{
+		// PUSH1 0xaa PUSH1 0 MSTORE8 PUSH1 1 PUSH1 0 RETURN
+		{[]byte{0x60, 0xaa, 0x60, 0x00, 0x53, 0x60, 0x01, 0x60, 0x00, 0xf3}, nil, nil, []byte{0xaa}},
+		// PUSH1 0xaa PUSH1 0 MSTORE8 PUSH1 1 PUSH1 0 REVERT
+		{[]byte{0x60, 0xaa, 0x60, 0x00, 0x53, 0x60, 0x01, 0x60, 0x00, 0xfd}, []byte{0xaa}, evmc.Revert, nil},
+		// STOP, deploys empty code
+		{[]byte{0x00}, nil, nil, nil},
+	}
+	for i, tt := range tests {
+		for _, kind := range []evmc.CallKind{evmc.Create, evmc.Create2} {
+			var (
+				address = evmcTestAddress
+				host    = newTestHost()
+			)
+			output, _, createAddr, err := host.Call(kind, common.Address{}, address, new(big.Int), tt.initCode, 100000, 1, false, new(big.Int))
+			if err != tt.err {
+				t.Errorf("test %d, kind %d: error mismatch: have %v, want %v", i, kind, err, tt.err)
+			}
+			if !bytes.Equal(output, tt.output) {
+				t.Errorf("test %d, kind %d: output mismatch: have %x, want %x", i, kind, output, tt.output)
+			}
+			if err == nil {
+				if code := host.env.StateDB.GetCode(createAddr); !bytes.Equal(code, tt.deployed) {
+					t.Errorf("test %d, kind %d: deployed code mismatch: have %x, want %x", i, kind, code, tt.deployed)
+				}
+			}
+		}
+	}
+}
+
+// Tests that contract creation through the EVMC host is rejected at addresses
+// already in use by an account with a nonce or code (EIP-684).
+func TestEVMCHostCreateCollision(t *testing.T) {
+	tests := []struct {
+		nonce uint64
+		code  []byte
+	}{
+		{1, nil},          // nonzero nonce, no code
+		{0, []byte{0x00}}, // code, zero nonce
+		{1, []byte{0x00}}, // both
+	}
+	for i, tt := range tests {
+		var (
+			address = evmcTestAddress
+			host    = newTestHost()
+			target  = crypto.CreateAddress(address, 0)
+		)
+		host.env.StateDB.SetNonce(target, tt.nonce)
+		host.env.StateDB.SetCode(target, tt.code)
+
+		_, gasLeft, _, err := host.Call(evmc.Create, common.Address{}, address, new(big.Int), []byte{0x00}, 100000, 1, false, new(big.Int))
+		if err != evmc.Failure {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, err, evmc.Failure)
+		}
+		if gasLeft != 0 {
+			t.Errorf("test %d: gas left mismatch: have %d, want 0", i, gasLeft)
+		}
+		if nonce := host.env.StateDB.GetNonce(target); nonce != tt.nonce {
+			t.Errorf("test %d: target nonce changed: have %d, want %d", i, nonce, tt.nonce)
+		}
+	}
+}
+
+func TestEVMCRunEx(t *testing.T) {
+	tests := []struct {
+		err    error
+		output []byte
+		logs   int
+		runErr error
+	}{
+		{nil, []byte{0x01}, 1, nil},
+		{evmc.Revert, []byte{0x02}, 0, ErrExecutionReverted},
+	}
+	for i, tt := range tests {
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			host.EmitLog(evmcTestAddress, []common.Hash{{0x01}}, []byte{0xff})
+			return tt.output, gas - 100, tt.err
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		result := interpreter.RunEx(contract, nil, false)
+		if result.Err != tt.runErr {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, result.Err, tt.runErr)
+		}
+		if !bytes.Equal(result.Output, tt.output) {
+			t.Errorf("test %d: output mismatch: have %x, want %x", i, result.Output, tt.output)
+		}
+		if result.GasUsed != 100 || result.GasLeft != 900 {
+			t.Errorf("test %d: gas mismatch: have used %d left %d, want used 100 left 900", i, result.GasUsed, result.GasLeft)
+		}
+		if len(result.Logs) != tt.logs {
+			t.Errorf("test %d: log count mismatch: have %d, want %d", i, len(result.Logs), tt.logs)
+		}
+		if len(interpreter.logs) != tt.logs {
+			t.Errorf("test %d: retained log count mismatch: have %d, want %d", i, len(interpreter.logs), tt.logs)
+		}
+		if result.CreatedAddr != (common.Address{}) {
+			t.Errorf("test %d: unexpected created address %x", i, result.CreatedAddr)
+		}
+	}
+}
+
+func TestEVMCPanicRecovery(t *testing.T) {
+	faulty := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		panic("binding crashed")
+	})
+	interpreter, contract := newStubEVMC(faulty, 1000)
+	ret, err := interpreter.Run(contract, nil, false)
+	if err != evmcPanicError {
+		t.Errorf("error mismatch: have %v, want %v", err, evmcPanicError)
+	}
+	if ret != nil {
+		t.Errorf("unexpected output after panic: %x", ret)
+	}
+	if contract.Gas != 0 {
+		t.Errorf("gas left after panic: have %d, want 0", contract.Gas)
+	}
+	if interpreter.env.depth != 0 {
+		t.Errorf("call depth not restored: have %d, want 0", interpreter.env.depth)
+	}
+	// A regular VM failure is still reported as such.
+	failing := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		return nil, 0, evmc.Failure
+	})
+	interpreter, contract = newStubEVMC(failing, 1000)
+	if _, err := interpreter.Run(contract, nil, false); err == evmcPanicError {
+		t.Errorf("regular failure reported as panic")
+	}
+	// Panics of the host callbacks, here of a precompile called by the VM,
+	// are faults of the node and go through.
+	precompile := common.BytesToAddress([]byte{0x01, 0x00})
+	calling := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		_, gasLeft, _, err := host.Call(evmc.Call, precompile, evmcTestAddress, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		return nil, gasLeft, err
+	})
+	interpreter, contract = newStubEVMC(calling, 1000)
+	interpreter.env.vmConfig.CustomPrecompiles = []CustomPrecompile{{Address: precompile, Contract: panicPrecompile{}}}
+	defer func() {
+		r := recover()
+		if p, ok := r.(*evmcHostPanic); !ok || p.value != "state corrupted" {
+			t.Errorf("panic mismatch: have %v, want host panic of state corrupted", r)
+		}
+	}()
+	interpreter.Run(contract, nil, false)
+	t.Errorf("host callback panic recovered")
+}
+
+// panicPrecompile is a precompile panicking when run.
+type panicPrecompile struct{}
+
+func (panicPrecompile) RequiredGas(input []byte) uint64  { return 0 }
+func (panicPrecompile) Run(input []byte) ([]byte, error) { panic("state corrupted") }
+
+// Tests that logs emitted by EVMC frames reach the state in execution order,
+// with the logs of reverted sub-calls dropped.
+func TestEVMCLogOrdering(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte("callee"))
+	)
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		if depth > 0 {
+			host.EmitLog(callee, []common.Hash{{0x02}}, nil)
+			return nil, gas, evmc.Revert
+		}
+		host.EmitLog(address, []common.Hash{{0x01}}, nil)
+		if _, _, _, err := host.Call(evmc.Call, callee, address, new(big.Int), nil, gas/2, depth+1, false, new(big.Int)); err != evmc.Revert {
+			t.Errorf("sub-call error mismatch: have %v, want %v", err, evmc.Revert)
+		}
+		host.EmitLog(address, []common.Hash{{0x03}}, nil)
+		return nil, gas / 2, nil
+	})
+	interpreter, contract := newStubEVMC(vm, 100000)
+	interpreter.env.StateDB.SetCode(callee, []byte{byte(STOP)})
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	want := []common.Hash{{0x01}, {0x03}}
+	for name, logs := range map[string][]*types.Log{"state": interpreter.env.StateDB.(*state.StateDB).Logs(), "result": result.Logs} {
+		if len(logs) != len(want) {
+			t.Errorf("%s: log count mismatch: have %d, want %d", name, len(logs), len(want))
+			continue
+		}
+		for i, entry := range logs {
+			if entry.Topics[0] != want[i] {
+				t.Errorf("%s: log %d topic mismatch: have %x, want %x", name, i, entry.Topics[0], want[i])
+			}
+		}
+	}
+}
+
+// limitedEVMCVM is a stub VM reporting the latest revision it supports.
+type limitedEVMCVM struct {
+	stubEVMCVM
+	max evmc.Revision
+}
+
+func (vm limitedEVMCVM) MaxRevision() evmc.Revision { return vm.max }
+
+func TestEVMCValidate(t *testing.T) {
+	tests := []struct {
+		vm     evmcVM
+		config ctypes.ChainConfigurator
+		head   uint64
+		fail   bool
+	}{
+		{limitedEVMCVM{max: evmc.Istanbul}, params.AllEthashProtocolChanges, 0, false},
+		{limitedEVMCVM{max: evmc.Petersburg}, params.AllEthashProtocolChanges, 0, true},
+		{limitedEVMCVM{max: evmc.Byzantium}, params.MainnetChainConfig, 0, false}, // gap only ahead
+		{limitedEVMCVM{max: evmc.Byzantium}, params.MainnetChainConfig, 10000000, true},
+		{stubEVMCVM(nil), params.AllEthashProtocolChanges, 0, false}, // not queryable
+	}
+	for i, tt := range tests {
+		interpreter := &EVMC{instance: tt.vm, cap: evmc.CapabilityEVM1}
+		if err := interpreter.Validate(tt.config, new(big.Int).SetUint64(tt.head)); (err != nil) != tt.fail {
+			t.Errorf("test %d: validation mismatch: have %v, want failure %v", i, err, tt.fail)
+		}
+	}
+}
+
+func TestEVMCHostGetBlockHashProvider(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		host    = newTestHostContext(params.AllEthashProtocolChanges, 1000, address)
+		queried []uint64
+	)
+	host.env.GetHash = func(n uint64) common.Hash {
+		queried = append(queried, n)
+		if n == 999 {
+			return common.Hash{} // unknown to the provider
+		}
+		return crypto.Keccak256Hash(new(big.Int).SetUint64(n).Bytes())
+	}
+	tests := []struct {
+		number int64
+		want   common.Hash
+	}{
+		{998, crypto.Keccak256Hash(big.NewInt(998).Bytes())},
+		{744, crypto.Keccak256Hash(big.NewInt(744).Bytes())},
+		{999, common.Hash{}},
+		{743, common.Hash{}},  // out of the window
+		{1000, common.Hash{}}, // current block
+	}
+	for i, tt := range tests {
+		if have := host.GetBlockHash(tt.number); have != tt.want {
+			t.Errorf("test %d: hash mismatch for block %d: have %x, want %x", i, tt.number, have, tt.want)
+		}
+	}
+	if len(queried) != 3 {
+		t.Errorf("provider queried for blocks outside the window: %v", queried)
+	}
+}
+
+// Tests that a read-only execution can't modify the state through the EVMC
+// host, neither directly nor from sub-calls, even if the VM ignores the flag.
+func TestEVMCForcedReadOnly(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte("callee"))
+		key     = common.Hash{0x01}
+	)
+	var subcallStatic bool
+	var subcallErr error
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		if depth > 0 {
+			subcallStatic = static
+			host.SetStorage(callee, key, common.Hash{0x02})
+			return nil, gas, nil
+		}
+		_, gas, _, subcallErr = host.Call(evmc.Call, callee, address, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		host.SetStorage(address, key, common.Hash{0x01})
+		host.EmitLog(address, nil, nil)
+		return nil, gas, nil
+	})
+	interpreter, contract := newStubEVMC(vm, 100000)
+	statedb := interpreter.env.StateDB
+	statedb.SetCode(callee, []byte{byte(STOP)})
+
+	result := interpreter.RunEx(contract, nil, true)
+	if result.Err != ErrWriteProtection {
+		t.Errorf("error mismatch: have %v, want %v", result.Err, ErrWriteProtection)
+	}
+	if result.GasLeft != 0 {
+		t.Errorf("gas left mismatch: have %d, want 0", result.GasLeft)
+	}
+	if !subcallStatic {
+		t.Errorf("sub-call not executed as static")
+	}
+	if subcallErr == nil {
+		t.Errorf("write protected sub-call succeeded")
+	}
+	for _, addr := range []common.Address{address, callee} {
+		if value := statedb.GetState(addr, key); value != (common.Hash{}) {
+			t.Errorf("storage of %x modified: %x", addr, value)
+		}
+	}
+	if logs := statedb.(*state.StateDB).Logs(); len(logs) != 0 {
+		t.Errorf("logs emitted in read-only mode: %d", len(logs))
+	}
+	if interpreter.readOnly {
+		t.Errorf("read-only mode not reset after the execution")
+	}
+}
+
+// Tests that value transfers and contract creations in static contexts fail
+// the frame attempting them, whether the VM or the host enforces the context.
+func TestEVMCStaticWrites(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte("callee"))
+	)
+	tests := []struct {
+		name     string
+		kind     evmc.CallKind
+		value    int64
+		static   bool // whether the VM flags the sub-call as static
+		readOnly bool // whether the host forces the execution read-only
+	}{
+		{"static value call", evmc.Call, 1, true, false},
+		{"read-only value call", evmc.Call, 1, false, true},
+		{"static create", evmc.Create, 0, true, false},
+		{"read-only create", evmc.Create, 0, false, true},
+		{"read-only create2", evmc.Create2, 0, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		var (
+			called     bool
+			subcallErr error
+		)
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			if depth > 0 {
+				called = true
+				return nil, gas, nil
+			}
+			_, _, _, subcallErr = host.Call(tt.kind, callee, address, big.NewInt(tt.value), []byte{byte(STOP)}, gas/2, depth+1, tt.static, new(big.Int))
+			return nil, gas, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 100000)
+		statedb := interpreter.env.StateDB
+		statedb.SetCode(callee, []byte{byte(STOP)})
+		statedb.AddBalance(address, big.NewInt(10))
+
+		result := interpreter.RunEx(contract, nil, tt.readOnly)
+		if result.Err != ErrWriteProtection || result.GasLeft != 0 {
+			t.Errorf("%s: result mismatch: have %v/%d, want %v/0", tt.name, result.Err, result.GasLeft, ErrWriteProtection)
+		}
+		if subcallErr != evmc.Failure {
+			t.Errorf("%s: sub-call error mismatch: have %v, want %v", tt.name, subcallErr, evmc.Failure)
+		}
+		if called {
+			t.Errorf("%s: sub-call executed", tt.name)
+		}
+		if balance := statedb.GetBalance(address); balance.Cmp(big.NewInt(10)) != 0 {
+			t.Errorf("%s: balance mismatch: have %v, want 10", tt.name, balance)
+		}
+	}
+}
+
+func TestResolveEVMCPath(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "evmc-search")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	lib := "libstubvm" + sharedLibraryExt()
+	for _, dir := range dirs[1:] {
+		if err := ioutil.WriteFile(filepath.Join(dir, lib), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"stubvm", filepath.Join(dirs[1], lib)}, // first match wins
+		{lib, filepath.Join(dirs[1], lib)},
+		{"unknown", "unknown"},
+		{filepath.Join(dirs[2], lib), filepath.Join(dirs[2], lib)},
+	}
+	for i, tt := range tests {
+		if have := resolveEVMCPath(tt.name, dirs); have != tt.want {
+			t.Errorf("test %d: path mismatch for %q: have %q, want %q", i, tt.name, have, tt.want)
+		}
+	}
+}
+
+func TestEVMCHostGetCodeByHash(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		host    = newTestHost()
+		code    = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	)
+	statedb := host.env.StateDB.(*state.StateDB)
+	statedb.SetCode(address, code)
+	if _, err := statedb.Commit(false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if have := host.GetCodeByHash(crypto.Keccak256Hash(code)); !bytes.Equal(have, code) {
+		t.Errorf("code mismatch: have %x, want %x", have, code)
+	}
+	if have := host.GetCodeByHash(common.Hash{0x01}); len(have) != 0 {
+		t.Errorf("unknown hash returned code: %x", have)
+	}
+	if have := host.GetCodeByHash(crypto.Keccak256Hash(nil)); len(have) != 0 {
+		t.Errorf("empty code hash returned code: %x", have)
+	}
+}
+
+// Tests that sub-calls and creations through the EVMC host consume exactly
+// the gas of the same operation executed natively, for every call kind and
+// revision.
+func TestEVMCHostCallGasParity(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+
+		// PUSH1 1 PUSH1 0 SSTORE PUSH1 0 SLOAD STOP
+		writer = []byte{0x60, 0x01, 0x60, 0x00, 0x55, 0x60, 0x00, 0x54, 0x00}
+		// PUSH1 0 SLOAD STOP
+		reader = []byte{0x60, 0x00, 0x54, 0x00}
+	)
+	revisions := []struct {
+		name  string
+		block uint64
+	}{
+		{"Frontier", 0},
+		{"Homestead", 1150000},
+		{"TangerineWhistle", 2463000},
+		{"SpuriousDragon", 2675000},
+		{"Byzantium", 4370000},
+		{"Petersburg", 7280000},
+		{"Istanbul", 9069000},
+	}
+	kinds := []struct {
+		name   string
+		kind   evmc.CallKind
+		static bool
+		code   []byte
+	}{
+		{"call", evmc.Call, false, writer},
+		{"callcode", evmc.CallCode, false, writer},
+		{"delegatecall", evmc.DelegateCall, false, writer},
+		{"staticcall", evmc.Call, true, reader},
+		{"staticcall-write", evmc.Call, true, writer},
+		{"create", evmc.Create, false, writer},
+		{"create2", evmc.Create2, false, writer},
+	}
+	// native executes the operation directly on the EVM, the way the host
+	// is expected to.
+	native := func(env *EVM, caller ContractRef, kind evmc.CallKind, static bool, code []byte, gas uint64) (uint64, error) {
+		var (
+			gasLeft uint64
+			err     error
+		)
+		switch {
+		case kind == evmc.Call && static:
+			_, gasLeft, err = env.StaticCall(caller, callee, nil, gas)
+		case kind == evmc.Call:
+			_, gasLeft, err = env.Call(caller, callee, nil, gas, new(big.Int))
+		case kind == evmc.CallCode:
+			_, gasLeft, err = env.CallCode(caller, callee, nil, gas, new(big.Int))
+		case kind == evmc.DelegateCall:
+			_, gasLeft, err = env.DelegateCall(caller, callee, nil, gas)
+		case kind == evmc.Create:
+			_, _, gasLeft, err = env.Create(caller, code, gas, new(big.Int))
+			if !env.ChainConfig().IsEnabled(env.ChainConfig().GetEIP7Transition, env.BlockNumber) && err == ErrCodeStoreOutOfGas {
+				err = nil
+			}
+		case kind == evmc.Create2:
+			_, _, gasLeft, err = env.Create2(caller, code, gas, new(big.Int), uint256.NewInt().SetUint64(1))
+		}
+		return gasLeft, err
+	}
+	for _, rev := range revisions {
+		for _, k := range kinds {
+			// Plenty of gas, and too little gas to complete the execution.
+			for _, gas := range []uint64{100000, 5000} {
+				name := fmt.Sprintf("%s/%s/%d", rev.name, k.name, gas)
+
+				host := newTestHostContext(params.MainnetChainConfig, rev.block, caller)
+				host.env.StateDB.SetCode(callee, k.code)
+				_, hostGas, _, hostErr := host.Call(k.kind, callee, caller, new(big.Int), k.code, int64(gas), 1, k.static, big.NewInt(1))
+
+				ref := newTestHostContext(params.MainnetChainConfig, rev.block, caller)
+				ref.env.StateDB.SetCode(callee, k.code)
+				nativeGas, nativeErr := native(ref.env, ref.contract, k.kind, k.static, k.code, gas)
+
+				if uint64(hostGas) != nativeGas {
+					t.Errorf("%s: gas left mismatch: have %d, want %d", name, hostGas, nativeGas)
+				}
+				if (hostErr != nil) != (nativeErr != nil) {
+					t.Errorf("%s: error mismatch: have %v, want %v", name, hostErr, nativeErr)
+				}
+			}
+		}
+	}
+}
+
+func TestEVMCRunExCreatedCodeHash(t *testing.T) {
+	address := evmcTestAddress
+
+	for i, code := range [][]byte{{0x60, 0x00, 0x00}, nil} {
+		code := code
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			if kind != evmc.Create {
+				t.Errorf("test %d: kind mismatch: have %d, want %d", i, kind, evmc.Create)
+			}
+			return code, gas, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		interpreter.env.StateDB.SetCode(address, nil) // not deployed yet
+		contract.IsDeployment = true
+
+		result := interpreter.RunEx(contract, nil, false)
+		if result.Err != nil {
+			t.Fatalf("test %d: creation failed: %v", i, result.Err)
+		}
+		if result.CreatedAddr != address {
+			t.Errorf("test %d: created address mismatch: have %x, want %x", i, result.CreatedAddr, address)
+		}
+		if want := crypto.Keccak256Hash(code); result.CodeHash != want {
+			t.Errorf("test %d: code hash mismatch: have %x, want %x", i, result.CodeHash, want)
+		}
+	}
+	// Empty init code isn't executed, and deploys the empty code.
+	interpreter, contract := newStubEVMC(nil, 1000)
+	interpreter.env.StateDB.SetCode(address, nil)
+	contract.SetCallCode(&address, crypto.Keccak256Hash(nil), nil)
+	contract.IsDeployment = true
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("empty init code: creation failed: %v", result.Err)
+	}
+	if result.CreatedAddr != address {
+		t.Errorf("empty init code: created address mismatch: have %x, want %x", result.CreatedAddr, address)
+	}
+	if want := crypto.Keccak256Hash(nil); result.CodeHash != want {
+		t.Errorf("empty init code: code hash mismatch: have %x, want %x", result.CodeHash, want)
+	}
+}
+
+func TestEVMCInternalErrorMode(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte("callee"))
+	)
+	// The internal error is reported by a nested frame.
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		if depth > 0 {
+			return nil, 0, evmc.Error(-1)
+		}
+		_, gasLeft, _, err := host.Call(evmc.Call, callee, address, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		return nil, gasLeft, err
+	})
+	defer SetEVMCPanicOnInternalError(false)
+
+	// Graceful mode fails just the nested frame.
+	SetEVMCPanicOnInternalError(false)
+	interpreter, contract := newStubEVMC(vm, 1000)
+	interpreter.env.StateDB.SetCode(callee, []byte{byte(STOP)})
+	if _, err := interpreter.Run(contract, nil, false); err != evmc.Failure {
+		t.Errorf("error mismatch: have %v, want %v", err, evmc.Failure)
+	}
+	// Fail-fast mode panics through the outer frame.
+	SetEVMCPanicOnInternalError(true)
+	interpreter, contract = newStubEVMC(vm, 1000)
+	interpreter.env.StateDB.SetCode(callee, []byte{byte(STOP)})
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("internal error didn't panic")
+			}
+		}()
+		interpreter.Run(contract, nil, false)
+	}()
+}
+
+// Tests that EVMs sharing the same VM instance can execute concurrently, each
+// on its own state and in its own mode.
+func TestEVMCConcurrentExecution(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		key     = common.Hash{0x01}
+	)
+	shared := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		for i := byte(1); i <= 100; i++ {
+			host.SetStorage(address, key, common.Hash{i})
+		}
+		return nil, gas, nil
+	})
+	var (
+		errs = make(chan error, 2)
+		dbs  = make(chan StateDB, 2)
+	)
+	for _, readOnly := range []bool{false, true} {
+		go func(readOnly bool) {
+			interpreter, contract := newStubEVMC(shared, 100000)
+			for i := 0; i < 50; i++ {
+				if _, err := interpreter.Run(contract, nil, readOnly); readOnly != (err == ErrWriteProtection) {
+					errs <- fmt.Errorf("read-only %v: unexpected error %v", readOnly, err)
+					return
+				}
+				contract.Gas = 100000
+			}
+			errs <- nil
+			dbs <- interpreter.env.StateDB
+		}(readOnly)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The states were written independently, one of them not at all.
+	var written int
+	for i := 0; i < 2; i++ {
+		switch (<-dbs).GetState(address, key) {
+		case common.Hash{100}:
+			written++
+		case common.Hash{}:
+		default:
+			t.Errorf("unexpected storage value")
+		}
+	}
+	if written != 1 {
+		t.Errorf("written state count mismatch: have %d, want 1", written)
+	}
+}
+
+func TestEVMCHostGetInputSize(t *testing.T) {
+	for i, input := range [][]byte{nil, {0x01}, bytes.Repeat([]byte{0xff}, 100)} {
+		var size int
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			size = host.(evmc.InputSizeGetter).GetInputSize()
+			return nil, gas, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		if _, err := interpreter.Run(contract, input, false); err != nil {
+			t.Fatalf("test %d: execution failed: %v", i, err)
+		}
+		if size != len(input) {
+			t.Errorf("test %d: input size mismatch: have %d, want %d", i, size, len(input))
+		}
+	}
+}
+
+// Tests that a creation with empty init code dispatched to EVMC creates the
+// same empty-code account as the native interpreter.
+func TestEVMCCreateEmptyInitCode(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		unused = stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			t.Errorf("VM executed for empty init code")
+			return nil, gas, nil
+		})
+	)
+	interpreter, contract := newTestEVMC(unused, caller, 0)
+	_, evmcAddr, evmcGas, evmcErr := interpreter.env.Create(contract, nil, 100000, new(big.Int))
+
+	native := newTestHostContext(params.AllEthashProtocolChanges, 0, caller)
+	_, nativeAddr, nativeGas, nativeErr := native.env.Create(native.contract, nil, 100000, new(big.Int))
+
+	if evmcErr != nativeErr {
+		t.Errorf("error mismatch: have %v, want %v", evmcErr, nativeErr)
+	}
+	if evmcAddr != nativeAddr || evmcGas != nativeGas {
+		t.Errorf("creation mismatch: have %x/%d, want %x/%d", evmcAddr, evmcGas, nativeAddr, nativeGas)
+	}
+	evmcDB, nativeDB := interpreter.env.StateDB, native.env.StateDB
+	if !evmcDB.Exist(evmcAddr) {
+		t.Fatalf("account not created")
+	}
+	if have, want := evmcDB.GetNonce(evmcAddr), nativeDB.GetNonce(nativeAddr); have != want {
+		t.Errorf("nonce mismatch: have %d, want %d", have, want)
+	}
+	if have, want := evmcDB.GetCodeHash(evmcAddr), nativeDB.GetCodeHash(nativeAddr); have != want {
+		t.Errorf("code hash mismatch: have %x, want %x", have, want)
+	}
+}
+
+// echoPrecompile is a custom precompile returning its input.
+type echoPrecompile struct{}
+
+func (echoPrecompile) RequiredGas(input []byte) uint64  { return 10 }
+func (echoPrecompile) Run(input []byte) ([]byte, error) { return input, nil }
+
+// Tests that sub-calls through the EVMC host are dispatched to chain specific
+// precompiles once they are active.
+func TestEVMCHostCustomPrecompile(t *testing.T) {
+	var (
+		address    = evmcTestAddress
+		precompile = common.BytesToAddress([]byte{0x01, 0x00})
+		input      = []byte{0xde, 0xad}
+		custom     = []CustomPrecompile{{Address: precompile, Activation: 10, Contract: echoPrecompile{}}}
+	)
+	tests := []struct {
+		block   uint64
+		output  []byte
+		gasLeft int64
+	}{
+		{9, nil, 1000},
+		{10, input, 990},
+	}
+	for i, tt := range tests {
+		host := newTestHostContext(params.AllEthashProtocolChanges, tt.block, address)
+		host.env.vmConfig.CustomPrecompiles = custom
+		output, gasLeft, _, err := host.Call(evmc.Call, precompile, address, new(big.Int), input, 1000, 1, false, new(big.Int))
+		if err != nil {
+			t.Fatalf("test %d: call failed: %v", i, err)
+		}
+		if !bytes.Equal(output, tt.output) || gasLeft != tt.gasLeft {
+			t.Errorf("test %d: result mismatch: have %x/%d, want %x/%d", i, output, gasLeft, tt.output, tt.gasLeft)
+		}
+	}
+	// Precompiles are configured per EVM, other EVMs are unaffected.
+	if _, ok := newTestHostContext(params.AllEthashProtocolChanges, 10, address).env.precompile(precompile); ok {
+		t.Errorf("custom precompile leaked to an EVM not configured with it")
+	}
+	// Without a block number only precompiles active from genesis are.
+	host := newTestHost()
+	host.env.BlockNumber = nil
+	host.env.vmConfig.CustomPrecompiles = append(custom, CustomPrecompile{Address: address, Contract: echoPrecompile{}})
+	if _, ok := host.env.precompile(precompile); ok {
+		t.Errorf("custom precompile active without a block number")
+	}
+	if _, ok := host.env.precompile(address); !ok {
+		t.Errorf("genesis custom precompile inactive without a block number")
+	}
+}
+
+func BenchmarkEVMCEmitLogs(b *testing.B) {
+	var (
+		address = evmcTestAddress
+		topics  = []common.Hash{{0x01}, {0x02}}
+		data    = make([]byte, 32)
+	)
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		for i := 0; i < 1000; i++ {
+			host.EmitLog(address, topics, data)
+		}
+		return nil, gas, nil
+	})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		interpreter, contract := newStubEVMC(vm, 100000)
+		b.StartTimer()
+
+		if _, err := interpreter.Run(contract, nil, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// evmcSpecStorageStatus returns the status the EVMC specification assigns to
+// writing value new into a slot with the given original and current values.
+func evmcSpecStorageStatus(original, current, new common.Hash) evmc.StorageStatus {
+	switch {
+	case new == current:
+		return evmc.StorageUnchanged
+	case original != current:
+		return evmc.StorageModifiedAgain
+	case current == (common.Hash{}):
+		return evmc.StorageAdded
+	case new == (common.Hash{}):
+		return evmc.StorageDeleted
+	default:
+		return evmc.StorageModified
+	}
+}
+
+// evmcSpecStorageRefund returns the change of the refund counter the
+// specification requires for an SSTORE, under EIP-2200 if net is set and under
+// the legacy rules otherwise.
+func evmcSpecStorageRefund(original, current, new common.Hash, net bool) int64 {
+	zero := common.Hash{}
+	if !net {
+		if current != zero && new == zero {
+			return int64(vars.SstoreRefundGas)
+		}
+		return 0
+	}
+	if new == current {
+		return 0
+	}
+	if original == current {
+		if original != zero && new == zero {
+			return int64(vars.SstoreClearsScheduleRefundEIP2200)
+		}
+		return 0
+	}
+	var refund int64
+	if original != zero {
+		if current == zero {
+			refund -= int64(vars.SstoreClearsScheduleRefundEIP2200)
+		} else if new == zero {
+			refund += int64(vars.SstoreClearsScheduleRefundEIP2200)
+		}
+	}
+	if original == new {
+		if original == zero {
+			refund += int64(vars.SstoreSetGasEIP2200 - vars.SloadGasEIP2200)
+		} else {
+			refund += int64(vars.SstoreResetGasEIP2200 - vars.SloadGasEIP2200)
+		}
+	}
+	return refund
+}
+
+// Tests the storage statuses and refunds reported by the host against the
+// definitions of the EVMC specification, for every combination of original,
+// current and new value. With net gas metering they must match exactly. Before
+// it, the gas is priced off the current value alone, so the host reports
+// statuses relative to the current value, diverging from the specification for
+// dirty slots.
+func TestEVMCHostStorageStatusConformance(t *testing.T) {
+	values := []common.Hash{{}, {0x01}, {0x02}}
+	revisions := []struct {
+		name  string
+		block uint64
+		net   bool
+	}{
+		{"Byzantium", 4370000, false},
+		{"Petersburg", 7280000, false},
+		{"Istanbul", 9069000, true},
+	}
+	seen := make(map[evmc.StorageStatus]bool)
+	for _, rev := range revisions {
+		for _, original := range values {
+			for _, current := range values {
+				for _, value := range values {
+					host := newTestHostContext(params.MainnetChainConfig, rev.block, evmcTestAddress)
+					statedb := host.env.StateDB.(*state.StateDB)
+					statedb.SetState(evmcTestAddress, common.Hash{}, original)
+					statedb.Finalise(false) // keep the codeless contract
+					statedb.SetState(evmcTestAddress, common.Hash{}, current)
+					statedb.AddRefund(100000) // room for refunds taken back
+
+					name := fmt.Sprintf("%s: %x -> %x -> %x", rev.name, original[0], current[0], value[0])
+					want := evmcSpecStorageStatus(original, current, value)
+					if !rev.net {
+						want = evmcSpecStorageStatus(current, current, value)
+					}
+					have := host.SetStorage(evmcTestAddress, common.Hash{}, value)
+					seen[have] = true
+					if have != want {
+						t.Errorf("%s: status mismatch: have %d, want %d", name, have, want)
+					}
+					if spec := evmcSpecStorageStatus(original, current, value); have != spec {
+						t.Logf("%s: status %d diverges from the specification (%d)", name, have, spec)
+					}
+					if refund, want := int64(statedb.GetRefund())-100000, evmcSpecStorageRefund(original, current, value, rev.net); refund != want {
+						t.Errorf("%s: refund mismatch: have %d, want %d", name, refund, want)
+					}
+					if stored := statedb.GetState(evmcTestAddress, common.Hash{}); stored != value {
+						t.Errorf("%s: stored value mismatch: have %x, want %x", name, stored, value)
+					}
+				}
+			}
+		}
+	}
+	for _, status := range []evmc.StorageStatus{evmc.StorageUnchanged, evmc.StorageModified, evmc.StorageModifiedAgain, evmc.StorageAdded, evmc.StorageDeleted} {
+		if !seen[status] {
+			t.Errorf("status %d not covered", status)
+		}
+	}
+}
+
+func TestEVMCHostAccountExistsConformance(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		empty   = common.BytesToAddress([]byte("empty"))
+		missing = common.BytesToAddress([]byte("missing"))
+	)
+	tests := []struct {
+		name  string
+		block uint64
+		addr  common.Address
+		want  bool
+	}{
+		{"pre-EIP-161 empty", 0, empty, true},
+		{"pre-EIP-161 missing", 0, missing, false},
+		{"pre-EIP-161 contract", 0, address, true},
+		{"EIP-161 empty", 2675000, empty, false},
+		{"EIP-161 missing", 2675000, missing, false},
+		{"EIP-161 contract", 2675000, address, true},
+	}
+	for _, tt := range tests {
+		host := newTestHostContext(params.MainnetChainConfig, tt.block, address)
+		host.env.StateDB.SetCode(address, []byte{byte(STOP)})
+		host.env.StateDB.CreateAccount(empty)
+		if have := host.AccountExists(tt.addr); have != tt.want {
+			t.Errorf("%s: existence mismatch: have %v, want %v", tt.name, have, tt.want)
+		}
+	}
+}
+
+func TestEwasmDisabled(t *testing.T) {
+	SetEwasmDisabled(true)
+	defer SetEwasmDisabled(false)
+
+	// The Ewasm VM isn't loaded, neither set up.
+	InitEVMCEwasm("/path/to/ewasm")
+	if ewasmModule != nil {
+		t.Fatalf("Ewasm VM loaded while disabled")
+	}
+	host := newTestHost()
+	env := NewEVM(host.env.Context, host.env.StateDB, params.AllEthashProtocolChanges, Config{EWASMInterpreter: "ewasm", EVMInterpreter: "evm1"})
+	if len(env.interpreters) != 1 || env.interpreters[0].(*EVMC).cap != evmc.CapabilityEVM1 {
+		t.Fatalf("interpreter set mismatch: have %v, want EVM1 only", env.interpreters)
+	}
+	// Wasm code is rejected with an error.
+	var (
+		address  = common.BytesToAddress([]byte("ewasm"))
+		wasmCode = []byte("\x00asm\x01\x00\x00\x00")
+	)
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(address), new(big.Int), 1000)
+	contract.SetCallCode(&address, crypto.Keccak256Hash(wasmCode), wasmCode)
+	if _, err := run(env, contract, nil, false); err == nil {
+		t.Errorf("wasm code executed with Ewasm disabled")
+	}
+}
+
+func TestEVMCHostIsPrecompile(t *testing.T) {
+	tests := []struct {
+		block uint64
+		addr  common.Address
+		want  bool
+	}{
+		{0, common.BytesToAddress([]byte{1}), true},
+		{0, common.BytesToAddress([]byte{5}), false},        // modexp before Byzantium
+		{4370000, common.BytesToAddress([]byte{5}), true},   // modexp from Byzantium on
+		{9069000, common.BytesToAddress([]byte{9}), true},   // blake2f from Istanbul on
+		{9069000, common.BytesToAddress([]byte{10}), false}, // BLS12-381 not scheduled
+		{9069000, evmcTestAddress, false},
+	}
+	for i, tt := range tests {
+		host := newTestHostContext(params.MainnetChainConfig, tt.block, common.Address{})
+		var checker evmc.PrecompileChecker = host
+		if have := checker.IsPrecompile(tt.addr); have != tt.want {
+			t.Errorf("test %d: precompile mismatch for %x at block %d: have %v, want %v", i, tt.addr, tt.block, have, tt.want)
+		}
+	}
+}
+
+func TestEVMCGasMeter(t *testing.T) {
+	var (
+		root = common.BytesToAddress([]byte("root"))
+		a    = common.BytesToAddress([]byte("a"))
+		b    = common.BytesToAddress([]byte("b"))
+	)
+	// Every frame burns 10 gas of its own, the innermost one 100.
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		var callee common.Address
+		switch depth {
+		case 0:
+			callee = a
+		case 1:
+			callee = b
+		default:
+			return nil, gas - 100, nil
+		}
+		_, gasLeft, _, err := host.Call(evmc.Call, callee, common.Address{}, new(big.Int), nil, gas-10, depth+1, false, new(big.Int))
+		return nil, gasLeft, err
+	})
+	type call struct {
+		depth          int
+		caller, callee common.Address
+		gasUsed        uint64
+	}
+	var calls []call
+	interpreter, contract := newTestEVMC(vm, root, 10000)
+	interpreter.env.vmConfig.EVMCGasMeter = func(depth int, caller common.Address, callee common.Address, gasUsed uint64) {
+		calls = append(calls, call{depth, caller, callee, gasUsed})
+	}
+	interpreter.env.StateDB.SetCode(a, []byte{byte(STOP)})
+	interpreter.env.StateDB.SetCode(b, []byte{byte(STOP)})
+
+	if _, err := interpreter.Run(contract, nil, false); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	want := []call{
+		{1, a, b, 100},
+		{0, root, a, 110},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("callback count mismatch: have %d, want %d", len(calls), len(want))
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("callback %d mismatch: have %+v, want %+v", i, calls[i], want[i])
+		}
+	}
+}
+
+func TestEVMCHostCreateEndowment(t *testing.T) {
+	tests := []struct {
+		balance, value int64
+		ok             bool
+	}{
+		{100, 40, true},   // funded
+		{100, 100, true},  // whole balance
+		{100, 101, false}, // underfunded
+	}
+	for i, tt := range tests {
+		var (
+			address = evmcTestAddress
+			host    = newTestHost()
+			target  = crypto.CreateAddress(address, 0)
+		)
+		host.env.StateDB.AddBalance(address, big.NewInt(tt.balance))
+
+		_, gasLeft, createAddr, err := host.Call(evmc.Create, common.Address{}, address, big.NewInt(tt.value), []byte{byte(STOP)}, 100000, 1, false, new(big.Int))
+		if (err == nil) != tt.ok {
+			t.Fatalf("test %d: error mismatch: have %v, want ok %v", i, err, tt.ok)
+		}
+		if !tt.ok {
+			// The creation is refused up front, without consuming gas.
+			if gasLeft != 100000 {
+				t.Errorf("test %d: gas left mismatch: have %d, want 100000", i, gasLeft)
+			}
+			if host.env.StateDB.Exist(target) || host.env.StateDB.GetNonce(address) != 0 {
+				t.Errorf("test %d: state modified by refused creation", i)
+			}
+			continue
+		}
+		if createAddr != target {
+			t.Errorf("test %d: created address mismatch: have %x, want %x", i, createAddr, target)
+		}
+		if have := host.env.StateDB.GetBalance(target); have.Int64() != tt.value {
+			t.Errorf("test %d: endowment mismatch: have %v, want %d", i, have, tt.value)
+		}
+		if have := host.env.StateDB.GetBalance(address); have.Int64() != tt.balance-tt.value {
+			t.Errorf("test %d: creator balance mismatch: have %v, want %d", i, have, tt.balance-tt.value)
+		}
+	}
+}
+
+// Tests that static calls through the EVMC host return the output of
+// precompiles, also when the whole execution is read-only.
+func TestEVMCHostStaticCallPrecompile(t *testing.T) {
+	key, _ := crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	hash := crypto.Keccak256([]byte("message"))
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ecrecover input: hash, v, r, s
+	input := make([]byte, 128)
+	copy(input, hash)
+	input[63] = sig[64] + 27
+	copy(input[64:], sig[:64])
+
+	want := common.LeftPadBytes(crypto.PubkeyToAddress(key.PublicKey).Bytes(), 32)
+	for _, readOnly := range []bool{false, true} {
+		host := newTestHost()
+		host.interpreter.readOnly = readOnly
+
+		output, gasLeft, _, err := host.Call(evmc.Call, common.BytesToAddress([]byte{1}), common.Address{}, new(big.Int), input, 10000, 1, true, new(big.Int))
+		if err != nil {
+			t.Fatalf("read-only %v: static call failed: %v", readOnly, err)
+		}
+		if !bytes.Equal(output, want) {
+			t.Errorf("read-only %v: recovered address mismatch: have %x, want %x", readOnly, output, want)
+		}
+		if gasLeft != 10000-int64(vars.EcrecoverGas) {
+			t.Errorf("read-only %v: gas left mismatch: have %d, want %d", readOnly, gasLeft, 10000-vars.EcrecoverGas)
+		}
+		if host.writeViolation {
+			t.Errorf("read-only %v: precompile flagged as writing", readOnly)
+		}
+	}
+}
+
+// Tests that running out of gas for the code deposit of a creation is
+// tolerated until EIP-2 activates, whichever block the chain enables it at.
+func TestEVMCHostCreateCodeStoreOutOfGas(t *testing.T) {
+	var (
+		config  = &coregeth.CoreGethChainConfig{EIP2FBlock: big.NewInt(5)}
+		address = evmcTestAddress
+		// PUSH1 32 PUSH1 0 RETURN, deploying 32 bytes for 6400 gas
+		initCode = []byte{0x60, 0x20, 0x60, 0x00, 0xf3}
+	)
+	for _, block := range []uint64{4, 5} {
+		host := newTestHostContext(config, block, address)
+		_, _, createAddr, err := host.Call(evmc.Create, common.Address{}, address, new(big.Int), initCode, 1000, 1, false, new(big.Int))
+		if block < 5 {
+			if err != nil {
+				t.Fatalf("block %d: creation failed: %v", block, err)
+			}
+			if !host.env.StateDB.Exist(createAddr) || host.env.StateDB.GetCodeSize(createAddr) != 0 {
+				t.Errorf("block %d: empty account not left behind", block)
+			}
+		} else if err != evmc.Failure {
+			t.Errorf("block %d: error mismatch: have %v, want %v", block, err, evmc.Failure)
+		}
+	}
+}
+
+// countingEVMCVM is a stub VM "executing" one step per code byte, reporting
+// the steps of each execution.
+type countingEVMCVM struct {
+	steps map[evmc.HostContext]uint64
+}
+
+func (vm *countingEVMCVM) Execute(host evmc.HostContext, rev evmc.Revision,
+	kind evmc.CallKind, static bool, depth int, gas int64,
+	destination common.Address, sender common.Address, input []byte, value common.Hash,
+	code []byte, create2Salt common.Hash) ([]byte, int64, error) {
+	vm.steps[host] = uint64(len(code))
+	return nil, gas, nil
+}
+
+func (vm *countingEVMCVM) Steps(host evmc.HostContext) uint64 {
+	return vm.steps[host]
+}
+
+func TestEVMCRunExSteps(t *testing.T) {
+	// PUSH1 1 PUSH1 2 ADD POP STOP
+	code := []byte{0x60, 0x01, 0x60, 0x02, 0x01, 0x50, 0x00}
+
+	interpreter, contract := newStubEVMC(&countingEVMCVM{steps: make(map[evmc.HostContext]uint64)}, 1000)
+	contract.Code = code
+	if result := interpreter.RunEx(contract, nil, false); result.Steps != uint64(len(code)) {
+		t.Errorf("step count mismatch: have %d, want %d", result.Steps, len(code))
+	}
+	// VMs not counting steps report zero.
+	interpreter, contract = newStubEVMC(stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		return nil, gas, nil
+	}), 1000)
+	if result := interpreter.RunEx(contract, nil, false); result.Steps != 0 {
+		t.Errorf("step count reported by non-counting VM: %d", result.Steps)
+	}
+}
+
+func TestEVMCHostSnapshots(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		host    = newTestHost()
+		slot1   = common.Hash{0x01}
+		slot2   = common.Hash{0x02}
+		value   = common.Hash{0xff}
+	)
+	var snapshotter evmc.StateSnapshotter = host
+
+	outer := snapshotter.Snapshot()
+	host.SetStorage(address, slot1, value)
+	host.EmitLog(address, nil, nil)
+
+	inner := snapshotter.Snapshot()
+	host.SetStorage(address, slot2, value)
+	host.EmitLog(address, nil, nil)
+
+	snapshotter.RevertToSnapshot(inner)
+	if have := host.env.StateDB.GetState(address, slot2); have != (common.Hash{}) {
+		t.Errorf("inner change not reverted: %x", have)
+	}
+	if have := host.env.StateDB.GetState(address, slot1); have != value {
+		t.Errorf("outer change reverted by inner revert: %x", have)
+	}
+	if len(host.interpreter.logs) != 1 {
+		t.Errorf("log count after inner revert mismatch: have %d, want 1", len(host.interpreter.logs))
+	}
+	snapshotter.RevertToSnapshot(outer)
+	if have := host.env.StateDB.GetState(address, slot1); have != (common.Hash{}) {
+		t.Errorf("outer change not reverted: %x", have)
+	}
+	if logs := host.env.StateDB.(*state.StateDB).Logs(); len(logs) != 0 || len(host.interpreter.logs) != 0 {
+		t.Errorf("logs left after outer revert: %d", len(logs))
+	}
+	if host.badSnapshot {
+		t.Errorf("valid snapshot reverts flagged")
+	}
+	// Reverting again, or to a snapshot never taken, fails the frame instead
+	// of crashing in the StateDB.
+	for _, id := range []int{inner, 1234} {
+		host.badSnapshot = false
+		snapshotter.RevertToSnapshot(id)
+		if !host.badSnapshot {
+			t.Errorf("revert to unknown snapshot %d not flagged", id)
+		}
+	}
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		host.(evmc.StateSnapshotter).RevertToSnapshot(1234)
+		return nil, gas, nil
+	})
+	interpreter, contract := newStubEVMC(vm, 1000)
+	if result := interpreter.RunEx(contract, nil, false); result.Err != evmcSnapshotError || result.GasLeft != 0 {
+		t.Errorf("result mismatch: have %v/%d, want %v/0", result.Err, result.GasLeft, evmcSnapshotError)
+	}
+}
+
+// Tests that the transaction context seen by the VM is the same in every frame
+// of a deep call chain.
+func TestEVMCHostTxContextAcrossFrames(t *testing.T) {
+	var (
+		address  = evmcTestAddress
+		contexts []evmc.TxContext
+	)
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		contexts = append(contexts, host.GetTxContext(), host.GetTxContext())
+		if depth == 5 {
+			return nil, gas, nil
+		}
+		_, gasLeft, _, err := host.Call(evmc.Call, address, address, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		return nil, gasLeft, err
+	})
+	interpreter, contract := newStubEVMC(vm, 100000)
+	interpreter.env.Origin = common.BytesToAddress([]byte("origin"))
+	interpreter.env.GasPrice = big.NewInt(1000000000)
+
+	if _, err := interpreter.Run(contract, nil, false); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if len(contexts) != 12 {
+		t.Fatalf("frame count mismatch: have %d, want 12", len(contexts)/2)
+	}
+	for i, ctx := range contexts {
+		if ctx != contexts[0] {
+			t.Errorf("context %d (depth %d) differs: have %+v, want %+v", i, i/2, ctx, contexts[0])
+		}
+	}
+}
+
+func TestReadEVMCConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evmc-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		path    string
+		options []string
+		fail    bool
+	}{
+		{"/opt/evmone/libevmone.so\n", "/opt/evmone/libevmone.so", nil, false},
+		{"# evmone\n/opt/evmone/libevmone.so\n\nO=0\n  trace=1  \n", "/opt/evmone/libevmone.so", []string{"O=0", "trace=1"}, false},
+		{"/opt/hera/libhera.so\nsys:evm=a,b\n", "/opt/hera/libhera.so", []string{"sys:evm=a,b"}, false}, // comma in value
+		{"/opt/evmone/libevmone.so\nO\n", "", nil, true},                                                // option without value
+		{"# nothing here\n\n", "", nil, true},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("vm%d.conf", i))
+		if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		path, options, err := readEVMCConfigFile(file)
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: error mismatch: have %v, want failure %v", i, err, tt.fail)
+		}
+		if path != tt.path || fmt.Sprint(options) != fmt.Sprint(tt.options) {
+			t.Errorf("test %d: config mismatch: have %q %q, want %q %q", i, path, options, tt.path, tt.options)
+		}
+	}
+	if _, _, err := readEVMCConfigFile(filepath.Join(dir, "missing.conf")); err == nil {
+		t.Errorf("missing file accepted")
+	}
+}
+
+func TestEVMCHostTxContextCoinbase(t *testing.T) {
+	for _, coinbase := range []common.Address{common.BytesToAddress([]byte("miner")), {}} {
+		host := newTestHost()
+		host.env.Coinbase = coinbase
+		if have := host.GetTxContext().Coinbase; have != coinbase {
+			t.Errorf("coinbase mismatch: have %x, want %x", have, coinbase)
+		}
+	}
+}
+
+// Tests that the stipend of value-bearing calls, included in the gas by the
+// VM, is neither added again by the host nor lost in the gas returned.
+func TestEVMCHostCallStipend(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+		// PUSH1 0 SLOAD POP STOP, 805 gas in Istanbul
+		code  = []byte{0x60, 0x00, 0x54, 0x50, 0x00}
+		value = big.NewInt(1)
+	)
+	for _, gas := range []uint64{0, 1000} {
+		host := newTestHostContext(params.AllEthashProtocolChanges, 0, caller)
+		host.env.StateDB.AddBalance(caller, value)
+		host.env.StateDB.SetCode(callee, code)
+		_, hostGas, _, hostErr := host.Call(evmc.Call, callee, caller, value, nil, int64(gas+vars.CallStipend), 1, false, new(big.Int))
+
+		// The native CALL adds the stipend itself before calling.
+		ref := newTestHostContext(params.AllEthashProtocolChanges, 0, caller)
+		ref.env.StateDB.AddBalance(caller, value)
+		ref.env.StateDB.SetCode(callee, code)
+		_, nativeGas, nativeErr := ref.env.Call(ref.contract, callee, nil, gas+vars.CallStipend, value)
+
+		if hostErr != nil || nativeErr != nil {
+			t.Fatalf("gas %d: call failed: host %v, native %v", gas, hostErr, nativeErr)
+		}
+		if uint64(hostGas) != nativeGas {
+			t.Errorf("gas %d: gas left mismatch: have %d, want %d", gas, hostGas, nativeGas)
+		}
+		if want := gas + vars.CallStipend - 805; uint64(hostGas) != want {
+			t.Errorf("gas %d: gas left mismatch: have %d, want %d", gas, hostGas, want)
+		}
+	}
+}
+
+func TestEVMCRunExRevertDepth(t *testing.T) {
+	tests := []struct {
+		same     bool // whether the intermediate frame reverts with the revert data of the sub-call
+		store    bool // whether the intermediate frame writes storage after catching the revert
+		snapshot bool // whether the intermediate frame takes a snapshot after catching the revert
+		want     int
+	}{
+		{true, false, false, 2},
+		{false, false, false, 1},
+		{true, true, false, 1},
+		{true, false, true, 1},
+	}
+	for i, tt := range tests {
+		tt := tt
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			if depth == 2 {
+				return []byte("inner"), gas, evmc.Revert
+			}
+			output, gasLeft, _, err := host.Call(evmc.Call, evmcTestAddress, evmcTestAddress, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+			if err != evmc.Revert {
+				t.Errorf("test %d: sub-call error mismatch at depth %d: have %v, want %v", i, depth, err, evmc.Revert)
+			}
+			if depth == 1 {
+				if !tt.same {
+					output = []byte("caught")
+				}
+				if tt.store {
+					host.SetStorage(evmcTestAddress, common.Hash{0x01}, common.Hash{0x01})
+				}
+				if tt.snapshot {
+					host.(evmc.StateSnapshotter).Snapshot()
+				}
+			}
+			return output, gasLeft, evmc.Revert
+		})
+		interpreter, contract := newStubEVMC(vm, 100000)
+		result := interpreter.RunEx(contract, nil, false)
+		if result.Err != ErrExecutionReverted {
+			t.Fatalf("test %d: error mismatch: have %v, want %v", i, result.Err, ErrExecutionReverted)
+		}
+		if result.RevertDepth != tt.want {
+			t.Errorf("test %d: revert depth mismatch: have %d, want %d", i, result.RevertDepth, tt.want)
+		}
+	}
+}
+
+// Tests that CREATE2 through the EVMC host derives the address from the full
+// 256-bit salt and is rejected at addresses already holding a contract.
+func TestEVMCHostCreate2Collision(t *testing.T) {
+	var (
+		address  = evmcTestAddress
+		initCode = []byte{byte(STOP)}
+		salt     = common.HexToHash("0x0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+		target   = crypto.CreateAddress2(address, salt, crypto.Keccak256(initCode))
+	)
+	tests := []struct {
+		name    string
+		code    []byte
+		storage bool
+		ok      bool
+	}{
+		{"fresh", nil, false, true},
+		{"code", []byte{0x00}, false, false},
+		{"storage only", nil, true, true}, // not a collision before EIP-7610
+	}
+	for _, tt := range tests {
+		host := newTestHost()
+		if tt.code != nil {
+			host.env.StateDB.SetCode(target, tt.code)
+		}
+		if tt.storage {
+			host.env.StateDB.SetState(target, common.Hash{0x01}, common.Hash{0x01})
+		}
+		_, gasLeft, createAddr, err := host.Call(evmc.Create2, common.Address{}, address, new(big.Int), initCode, 100000, 1, false, salt.Big())
+		if !tt.ok {
+			if err != evmc.Failure || gasLeft != 0 {
+				t.Errorf("%s: collision result mismatch: have %v/%d, want %v/0", tt.name, err, gasLeft, evmc.Failure)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: creation failed: %v", tt.name, err)
+		}
+		if createAddr != target {
+			t.Errorf("%s: created address mismatch: have %x, want %x", tt.name, createAddr, target)
+		}
+	}
+}
+
+func TestSetEVMCLogger(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records []*log.Record
+	)
+	logger := log.New("subsystem", "evmc")
+	logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		records = append(records, r)
+		mu.Unlock()
+		return nil
+	}))
+	SetEVMCLogger(logger)
+	defer SetEVMCLogger(nil)
+
+	// Log concurrently from several executions.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			host := newTestHost()
+			host.Call(evmc.CallKind(100), common.Address{}, common.Address{}, new(big.Int), nil, 0, 1, false, new(big.Int))
+		}()
+	}
+	wg.Wait()
+
+	if len(records) != 4 {
+		t.Fatalf("captured log count mismatch: have %d, want 4", len(records))
+	}
+	for i, r := range records {
+		if r.Lvl != log.LvlError || len(r.Ctx) < 2 || r.Ctx[0] != "subsystem" || r.Ctx[1] != "evmc" {
+			t.Errorf("record %d: unexpected record %v %v", i, r.Lvl, r.Ctx)
+		}
+	}
+	// Internal VM errors are reported through the logger too.
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		return nil, 0, evmc.Error(-1)
+	})
+	interpreter, contract := newStubEVMC(vm, 100)
+	if _, err := interpreter.Run(contract, nil, false); err == nil {
+		t.Fatalf("internal error not reported")
+	}
+	if len(records) != 5 || records[4].Msg != "EVMC: VM internal error" {
+		t.Errorf("internal error not logged: %d records", len(records))
+	}
+	SetEVMCLogger(nil)
+	if evmcLogger() != log.Root() {
+		t.Errorf("root logger not restored")
+	}
+}
+
+func TestEVMCHostDelegateCallFailure(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+	)
+	tests := []struct {
+		name string
+		code []byte
+		gas  uint64
+		err  error
+	}{
+		// PUSH1 0 PUSH1 0 REVERT
+		{"revert", []byte{0x60, 0x00, 0x60, 0x00, 0xfd}, 100000, evmc.Revert},
+		// INVALID
+		{"invalid", []byte{0xfe}, 100000, evmc.Failure},
+		// PUSH1 1 PUSH1 0 SSTORE STOP
+		{"out-of-gas", []byte{0x60, 0x01, 0x60, 0x00, 0x55, 0x00}, 5000, evmc.Failure},
+	}
+	for _, tt := range tests {
+		host := newTestHostContext(params.MainnetChainConfig, 9069000, caller)
+		host.env.StateDB.SetCode(callee, tt.code)
+		_, gasLeft, _, err := host.Call(evmc.DelegateCall, callee, caller, new(big.Int), nil, int64(tt.gas), 1, false, new(big.Int))
+
+		ref := newTestHostContext(params.MainnetChainConfig, 9069000, caller)
+		ref.env.StateDB.SetCode(callee, tt.code)
+		_, nativeGas, _ := ref.env.DelegateCall(ref.contract, callee, nil, tt.gas)
+
+		if err != tt.err {
+			t.Errorf("%s: error mismatch: have %v, want %v", tt.name, err, tt.err)
+		}
+		if uint64(gasLeft) != nativeGas {
+			t.Errorf("%s: gas left mismatch: have %d, want %d", tt.name, gasLeft, nativeGas)
+		}
+		if tt.err == evmc.Revert && gasLeft == 0 {
+			t.Errorf("%s: reverted call consumed all gas", tt.name)
+		}
+		if tt.err == evmc.Failure && gasLeft != 0 {
+			t.Errorf("%s: failed call returned gas: have %d, want 0", tt.name, gasLeft)
+		}
+	}
+}
+
+func TestEVMCHostTxContextGasLimit(t *testing.T) {
+	tests := []struct {
+		gasLimit uint64
+		want     int64
+	}{
+		{8000000, 8000000},
+		{math.MaxInt64 - 1, math.MaxInt64 - 1},
+		{math.MaxInt64, math.MaxInt64},
+		{math.MaxInt64 + 1, math.MaxInt64},
+		{math.MaxUint64, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		host := newTestHost()
+		host.env.GasLimit = tt.gasLimit
+		if have := host.GetTxContext().GasLimit; have != tt.want {
+			t.Errorf("gas limit %d: reported limit mismatch: have %d, want %d", tt.gasLimit, have, tt.want)
+		}
+	}
+}
+
+func TestEVMCSelfTest(t *testing.T) {
+	tests := []struct {
+		name string
+		vm   stubEVMCVM
+		ok   bool
+	}{
+		{"good", func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return []byte{0x2a}, gas - 18, nil
+		}, true},
+		{"crashing", func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			panic("broken VM")
+		}, false},
+		{"failing", func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return nil, 0, evmc.Failure
+		}, false},
+		{"wrong-output", func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return nil, gas - 18, nil
+		}, false},
+		{"wrong-gas", func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return []byte{0x2a}, gas, nil
+		}, false},
+	}
+	for _, tt := range tests {
+		if err := selfTestEVMC(tt.vm); (err == nil) != tt.ok {
+			t.Errorf("%s: self-test result mismatch: have %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestScopeEVMCOptions(t *testing.T) {
+	options := []string{"O=2", "evm1.trace=1", "ewasm.metering=true", "invalid", "ewasm.O=0"}
+	tests := []struct {
+		cap  evmc.Capability
+		want []evmcOption
+	}{
+		{evmc.CapabilityEVM1, []evmcOption{{"O", "2"}, {"trace", "1"}}},
+		{evmc.CapabilityEWASM, []evmcOption{{"O", "2"}, {"metering", "true"}, {"O", "0"}}},
+	}
+	for _, tt := range tests {
+		have := scopeEVMCOptions(tt.cap, options)
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("capability %d: options mismatch: have %v, want %v", tt.cap, have, tt.want)
+		}
+	}
+}
+
+func TestEVMCRunExCallKind(t *testing.T) {
+	var kinds []evmc.CallKind
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		kinds = append(kinds, kind)
+		if depth == 0 {
+			host.Call(evmc.Create, common.Address{}, evmcTestAddress, new(big.Int), []byte{byte(STOP)}, gas/2, depth+1, false, new(big.Int))
+		}
+		return nil, gas, nil
+	})
+	// Code running on behalf of an account without code, e.g. self-destructed
+	// or delegated to by init code, is not a creation.
+	interpreter, contract := newStubEVMC(vm, 100000)
+	interpreter.env.StateDB.SetCode(evmcTestAddress, nil)
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	if result.CreatedAddr != (common.Address{}) {
+		t.Errorf("call reported a created address %x", result.CreatedAddr)
+	}
+	if want := []evmc.CallKind{evmc.Call, evmc.Create}; fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Errorf("kinds mismatch: have %v, want %v", kinds, want)
+	}
+}
+
+func TestEVMCOutOfGasError(t *testing.T) {
+	for _, status := range []error{evmc.OutOfGas, evmc.Failure} {
+		status := status
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return nil, 0, status
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		err := interpreter.RunEx(contract, nil, false).Err
+
+		if status != evmc.OutOfGas {
+			// Failures unrelated to gas are passed through as is.
+			if err != status {
+				t.Errorf("error mismatch: have %v, want %v", err, status)
+			}
+			continue
+		}
+		oog, ok := err.(*ErrEVMCOutOfGas)
+		if !ok {
+			t.Fatalf("error type mismatch: have %T (%v), want *ErrEVMCOutOfGas", err, err)
+		}
+		if oog.available != 1000 {
+			t.Errorf("available gas mismatch: have %d, want 1000", oog.available)
+		}
+		if !errors.Is(err, ErrOutOfGas) {
+			t.Errorf("error doesn't match ErrOutOfGas")
+		}
+	}
+}
+
+func TestEVMCSimulation(t *testing.T) {
+	tests := []struct {
+		used    int64 // gas used by the VM, -1 to run out of gas
+		err     error
+		gasLeft uint64
+	}{
+		{100, nil, 900},
+		{1000, nil, 0},         // all the call has
+		{5000, ErrOutOfGas, 0}, // more than the call has, failing like the real call
+		{-1, ErrOutOfGas, 0},   // an endless loop terminates on the budget
+	}
+	for i, tt := range tests {
+		var budget int64
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			budget = gas
+			if tt.used < 0 {
+				return nil, 0, evmc.OutOfGas
+			}
+			return nil, gas - tt.used, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		interpreter.env.vmConfig.EVMCSimulationGas = 10000000
+
+		result := interpreter.RunEx(contract, nil, false)
+		if budget != 10000000 {
+			t.Errorf("test %d: budget mismatch: have %d, want 10000000", i, budget)
+		}
+		if !errors.Is(result.Err, tt.err) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, result.Err, tt.err)
+		}
+		if contract.Gas != tt.gasLeft || result.GasLeft != tt.gasLeft {
+			t.Errorf("test %d: gas left mismatch: have %d/%d, want %d", i, contract.Gas, result.GasLeft, tt.gasLeft)
+		}
+		if want := uint64(tt.used); tt.used >= 0 && result.GasUsed != want {
+			t.Errorf("test %d: gas used mismatch: have %d, want %d", i, result.GasUsed, want)
+		}
+	}
+}
+
+func TestEVMCRunExRevision(t *testing.T) {
+	tests := []struct {
+		block uint64
+		want  evmc.Revision
+	}{
+		{4369999, evmc.SpuriousDragon},
+		{4370000, evmc.Byzantium},
+		{9068999, evmc.Petersburg},
+		{9069000, evmc.Istanbul},
+	}
+	for _, tt := range tests {
+		var executed evmc.Revision
+		vm := revisionRecorder(func(rev evmc.Revision) { executed = rev })
+		interpreter, contract := newStubEVMC(vm, 1000)
+		interpreter.env.chainConfig = params.MainnetChainConfig
+		interpreter.env.BlockNumber = new(big.Int).SetUint64(tt.block)
+
+		result := interpreter.RunEx(contract, nil, false)
+		if result.Revision != tt.want || executed != tt.want {
+			t.Errorf("block %d: revision mismatch: have %v (executed %v), want %v", tt.block, result.Revision, executed, tt.want)
+		}
+		if have := getRevision(interpreter.env); have != result.Revision {
+			t.Errorf("block %d: revision differs from getRevision: have %v, want %v", tt.block, result.Revision, have)
+		}
+	}
+}
+
+// revisionRecorder is an EVMC VM reporting the revision of every execution.
+type revisionRecorder func(rev evmc.Revision)
+
+func (vm revisionRecorder) Execute(host evmc.HostContext, rev evmc.Revision,
+	kind evmc.CallKind, static bool, depth int, gas int64,
+	destination common.Address, sender common.Address, input []byte, value common.Hash,
+	code []byte, create2Salt common.Hash) ([]byte, int64, error) {
+	vm(rev)
+	return nil, gas, nil
+}
+
+func TestEVMCMaxOutputSize(t *testing.T) {
+	// Output returned by the VM.
+	for _, size := range []int{1024, 1025} {
+		size := size
+		vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			return make([]byte, size), gas, nil
+		})
+		interpreter, contract := newStubEVMC(vm, 1000)
+		interpreter.env.vmConfig.EVMCMaxOutputSize = 1024
+
+		result := interpreter.RunEx(contract, nil, false)
+		if size <= 1024 {
+			if result.Err != nil || len(result.Output) != size {
+				t.Errorf("size %d: bounded output rejected: %v", size, result.Err)
+			}
+			continue
+		}
+		if result.Err != evmcOutputError || result.Output != nil || result.GasLeft != 0 {
+			t.Errorf("size %d: oversized output accepted: have %v, %d bytes, gas %d", size, result.Err, len(result.Output), result.GasLeft)
+		}
+	}
+	// Output returned to the VM by a sub-call, undoing its state changes.
+	callee := common.BytesToAddress([]byte("callee"))
+	host := newTestHost()
+	host.env.vmConfig.EVMCMaxOutputSize = 1024
+	// PUSH1 1 PUSH1 0 SSTORE PUSH2 2000 PUSH1 0 RETURN
+	host.env.StateDB.SetCode(callee, []byte{0x60, 0x01, 0x60, 0x00, 0x55, 0x61, 0x07, 0xd0, 0x60, 0x00, 0xf3})
+
+	output, gasLeft, _, err := host.Call(evmc.Call, callee, evmcTestAddress, new(big.Int), nil, 100000, 1, false, new(big.Int))
+	if err != evmc.Failure || output != nil || gasLeft != 0 {
+		t.Errorf("oversized sub-call output accepted: have %v, %d bytes, gas %d", err, len(output), gasLeft)
+	}
+	if value := host.env.StateDB.GetState(callee, common.Hash{}); value != (common.Hash{}) {
+		t.Errorf("state changes of the failed sub-call kept: have %x", value)
+	}
+	// Logs of EVMC frames nested in the sub-call are dropped along with its
+	// state changes. Here an Ewasm frame calls an EVM1 contract, run by the
+	// native interpreter, which calls an Ewasm contract emitting a log, and
+	// returns too much output: PUSH1 0 x5 PUSH1 0x77 GAS CALL POP PUSH2 2000
+	// PUSH1 0 RETURN
+	var (
+		native     = common.BytesToAddress([]byte("native"))
+		wasm       = common.BytesToAddress([]byte{0x77})
+		wasmCode   = []byte("\x00asm\x01\x00\x00\x00")
+		nativeCode = []byte{0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x77, 0x5a, 0xf1, 0x50, 0x61, 0x07, 0xd0, 0x60, 0x00, 0xf3}
+	)
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		if depth > 0 {
+			host.EmitLog(wasm, nil, nil)
+			return nil, gas, nil
+		}
+		_, gasLeft, _, err := host.Call(evmc.Call, native, wasm, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		if err != evmc.Failure {
+			t.Errorf("sub-call error mismatch: have %v, want %v", err, evmc.Failure)
+		}
+		return nil, gasLeft, nil
+	})
+	interpreter, _ := newStubEVMC(vm, 0)
+	interpreter.cap = evmc.CapabilityEWASM
+	env := interpreter.env
+	env.vmConfig.EVMCMaxOutputSize = 1024
+	env.interpreters = []Interpreter{interpreter, NewEVMInterpreter(env, env.vmConfig)}
+	env.StateDB.SetCode(wasm, wasmCode)
+	env.StateDB.SetCode(native, nativeCode)
+	contract := NewContract(AccountRef(common.Address{}), AccountRef(wasm), new(big.Int), 100000)
+	contract.SetCallCode(&wasm, crypto.Keccak256Hash(wasmCode), wasmCode)
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	if len(result.Logs) != 0 || len(interpreter.logs) != 0 {
+		t.Errorf("logs of the failed sub-call kept: have %d reported, %d retained", len(result.Logs), len(interpreter.logs))
+	}
+	if logs := env.StateDB.(*state.StateDB).Logs(); len(logs) != 0 {
+		t.Errorf("logs of the failed sub-call kept in the state: have %d", len(logs))
+	}
+}
+
+func TestEVMCHostNoopSStore(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		slot    = common.Hash{0x01}
+		value   = common.Hash{0x02}
+	)
+	tests := []struct {
+		noop   EVMCNoopSStoreFunc
+		status evmc.StorageStatus
+		refund uint64
+		gas    uint64
+	}{
+		{nil, evmc.StorageUnchanged, 0, vars.SloadGasEIP2200},
+		{func(env *EVM, addr common.Address, key common.Hash) (evmc.StorageStatus, uint64) {
+			return evmc.StorageModified, 100
+		}, evmc.StorageModified, 100, vars.SstoreResetGasEIP2200},
+	}
+	for i, tt := range tests {
+		host := newTestHost()
+		host.env.vmConfig.EVMCNoopSStore = tt.noop
+		host.env.StateDB.SetState(address, slot, value)
+
+		status := host.SetStorage(address, slot, value)
+		if status != tt.status {
+			t.Errorf("test %d: status mismatch: have %v, want %v", i, status, tt.status)
+		}
+		if refund := host.env.StateDB.GetRefund(); refund != tt.refund {
+			t.Errorf("test %d: refund mismatch: have %d, want %d", i, refund, tt.refund)
+		}
+		if gas := sstoreGas(host.env, status); gas != tt.gas {
+			t.Errorf("test %d: gas mismatch: have %d, want %d", i, gas, tt.gas)
+		}
+		if have := host.env.StateDB.GetState(address, slot); have != value {
+			t.Errorf("test %d: value changed: have %x, want %x", i, have, value)
+		}
+	}
+}
+
+// miniEVMCVM is a deterministic EVMC VM written in Go, running a tiny
+// instruction set on a stack of uint64 words. It lets tests exercise the host,
+// Run, CanRun and the error mapping without an external VM installed. Every
+// instruction costs 1 gas, sub-calls are given all the gas left.
+//
+//	0x00 STOP      stop
+//	0x01 ADD       push a + b
+//	0x54 SLOAD     push the storage value at the popped key
+//	0x55 SSTORE    store the second item at the popped key
+//	0x60 PUSH1 n   push n
+//	0xef STATUS    stop with the popped status code, taken as a signed byte
+//	0xf1 CALL      call the popped one byte address, push 1 on success
+//	0xf3 RETURN    return the popped word
+//	0xfd REVERT    revert with the popped word
+type miniEVMCVM struct{}
+
+// miniEVMCArity holds the number of stack items taken by the instructions of
+// miniEVMCVM, other than PUSH1.
+var miniEVMCArity = map[byte]int{
+	0x00: 0, 0x01: 2, 0x54: 1, 0x55: 2, 0xef: 1, 0xf1: 1, 0xf3: 1, 0xfd: 1,
+}
+
+func (miniEVMCVM) Execute(host evmc.HostContext, rev evmc.Revision,
+	kind evmc.CallKind, static bool, depth int, gas int64,
+	destination common.Address, sender common.Address, input []byte, value common.Hash,
+	code []byte, create2Salt common.Hash) ([]byte, int64, error) {
+
+	word := func(v uint64) common.Hash { return common.BigToHash(new(big.Int).SetUint64(v)) }
+
+	var stack []uint64
+	for pc := 0; pc < len(code); pc++ {
+		if gas == 0 {
+			return nil, 0, evmc.OutOfGas
+		}
+		gas--
+
+		op := code[pc]
+		if op == 0x60 {
+			if pc++; pc == len(code) {
+				return nil, 0, evmc.Failure
+			}
+			stack = append(stack, uint64(code[pc]))
+			continue
+		}
+		n, ok := miniEVMCArity[op]
+		if !ok || len(stack) < n {
+			return nil, 0, evmc.Failure
+		}
+		args := stack[len(stack)-n:] // the top item comes last
+		stack = stack[:len(stack)-n]
+
+		switch op {
+		case 0x00:
+			return nil, gas, nil
+		case 0x01:
+			stack = append(stack, args[0]+args[1])
+		case 0x54:
+			stored := host.GetStorage(destination, word(args[0]))
+			stack = append(stack, new(big.Int).SetBytes(stored[:]).Uint64())
+		case 0x55:
+			if static {
+				return nil, 0, evmc.Failure
+			}
+			host.SetStorage(destination, word(args[1]), word(args[0]))
+		case 0xef:
+			if args[0] == 0 {
+				return nil, gas, nil
+			}
+			return nil, 0, evmc.Error(int8(args[0]))
+		case 0xf1:
+			callee := common.BytesToAddress([]byte{byte(args[0])})
+			_, gasLeft, _, err := host.Call(evmc.Call, callee, destination, new(big.Int), nil, gas, depth+1, static, new(big.Int))
+			gas = gasLeft
+			if err != nil {
+				stack = append(stack, 0)
+			} else {
+				stack = append(stack, 1)
+			}
+		case 0xf3:
+			return word(args[0]).Bytes(), gas, nil
+		case 0xfd:
+			return word(args[0]).Bytes(), gas, evmc.Revert
+		}
+	}
+	return nil, gas, nil
+}
+
+// newMiniEVMC creates an EVMC interpreter running miniEVMCVM, along with a
+// contract to run the given code at the test address.
+func newMiniEVMC(code []byte, gas uint64) (*EVMC, *Contract) {
+	address := evmcTestAddress
+	interpreter, contract := newStubEVMC(miniEVMCVM{}, gas)
+	interpreter.env.StateDB.SetCode(address, code)
+	contract.SetCallCode(&address, crypto.Keccak256Hash(code), code)
+	return interpreter, contract
+}
+
+func TestEVMCMiniVM(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte{0x42})
+	)
+	// Storage access and output: PUSH1 7 PUSH1 1 SSTORE PUSH1 1 SLOAD PUSH1 1 ADD RETURN
+	interpreter, contract := newMiniEVMC([]byte{0x60, 0x07, 0x60, 0x01, 0x55, 0x60, 0x01, 0x54, 0x60, 0x01, 0x01, 0xf3}, 100)
+	if !interpreter.CanRun(contract.Code) || interpreter.CanRun([]byte("\x00asm\x01\x00\x00\x00")) {
+		t.Errorf("CanRun mismatch")
+	}
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	if want := common.BigToHash(big.NewInt(8)).Bytes(); !bytes.Equal(result.Output, want) {
+		t.Errorf("output mismatch: have %x, want %x", result.Output, want)
+	}
+	if result.GasUsed != 8 {
+		t.Errorf("gas used mismatch: have %d, want 8", result.GasUsed)
+	}
+	if value := interpreter.env.StateDB.GetState(address, common.BigToHash(big.NewInt(1))); value != common.BigToHash(big.NewInt(7)) {
+		t.Errorf("storage mismatch: have %x, want 7", value)
+	}
+
+	// Sub-calls through the host: PUSH1 0x42 CALL RETURN, calling
+	// PUSH1 9 PUSH1 2 SSTORE STOP.
+	interpreter, contract = newMiniEVMC([]byte{0x60, 0x42, 0xf1, 0xf3}, 100)
+	interpreter.env.StateDB.SetCode(callee, []byte{0x60, 0x09, 0x60, 0x02, 0x55, 0x00})
+	result = interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("calling execution failed: %v", result.Err)
+	}
+	if want := common.BigToHash(big.NewInt(1)).Bytes(); !bytes.Equal(result.Output, want) {
+		t.Errorf("sub-call result mismatch: have %x, want %x", result.Output, want)
+	}
+	if value := interpreter.env.StateDB.GetState(callee, common.BigToHash(big.NewInt(2))); value != common.BigToHash(big.NewInt(9)) {
+		t.Errorf("sub-call storage mismatch: have %x, want 9", value)
+	}
+
+	// Running out of gas: PUSH1 0 PUSH1 0 PUSH1 0 STOP
+	interpreter, contract = newMiniEVMC([]byte{0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x00}, 2)
+	if err := interpreter.RunEx(contract, nil, false).Err; !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("out of gas error mismatch: have %v, want %v", err, ErrOutOfGas)
+	}
+}
+
+// Tests the mapping of every EVMC status code to the errors returned by Run.
+func TestEVMCMiniVMStatusCodes(t *testing.T) {
+	for code := -4; code <= 17; code++ {
+		interpreter, contract := newMiniEVMC([]byte{0x60, byte(int8(code)), 0xef}, 100)
+		err := interpreter.RunEx(contract, nil, false).Err
+
+		switch status := evmc.Error(code); {
+		case code == 0:
+			if err != nil {
+				t.Errorf("status %d: error mismatch: have %v, want nil", code, err)
+			}
+		case status == evmc.Revert:
+			if err != ErrExecutionReverted {
+				t.Errorf("status %d: error mismatch: have %v, want %v", code, err, ErrExecutionReverted)
+			}
+		case status == evmc.OutOfGas:
+			if _, ok := err.(*ErrEVMCOutOfGas); !ok {
+				t.Errorf("status %d: error mismatch: have %v, want out of gas", code, err)
+			}
+		case status.IsInternalError():
+			if err == nil || !strings.HasPrefix(err.Error(), evmcModuleError.Error()) {
+				t.Errorf("status %d: error mismatch: have %v, want internal error", code, err)
+			}
+		default:
+			if err != status {
+				t.Errorf("status %d: error mismatch: have %v, want %v", code, err, status)
+			}
+		}
+	}
+}
+
+func TestEVMCCallbackCounts(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		callee  = common.BytesToAddress([]byte{0x42})
+	)
+	// Two SSTOREs and an SLOAD, then a call to a contract doing an SLOAD and
+	// an SSTORE: PUSH1 1 PUSH1 1 SSTORE PUSH1 2 PUSH1 2 SSTORE PUSH1 1 SLOAD
+	// PUSH1 0x42 CALL STOP
+	code := []byte{0x60, 0x01, 0x60, 0x01, 0x55, 0x60, 0x02, 0x60, 0x02, 0x55, 0x60, 0x01, 0x54, 0x60, 0x42, 0xf1, 0x00}
+	interpreter, contract := newMiniEVMC(code, 1000)
+	// PUSH1 1 SLOAD PUSH1 1 SSTORE STOP
+	interpreter.env.StateDB.SetCode(callee, []byte{0x60, 0x01, 0x54, 0x60, 0x01, 0x55, 0x00})
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	want := EVMCCallbackCounts{GetStorage: 2, SetStorage: 3, Call: 1}
+	if result.Callbacks != want {
+		t.Errorf("callback counts mismatch: have %+v, want %+v", result.Callbacks, want)
+	}
+	// Later executions only report their own callbacks: PUSH1 1 SLOAD STOP
+	code = []byte{0x60, 0x01, 0x54, 0x00}
+	contract.SetCallCode(&address, crypto.Keccak256Hash(code), code)
+	contract.Gas = 1000
+	if have := interpreter.RunEx(contract, nil, false).Callbacks; have != (EVMCCallbackCounts{GetStorage: 1}) {
+		t.Errorf("callback counts of second run mismatch: have %+v, want %+v", have, EVMCCallbackCounts{GetStorage: 1})
+	}
+	// The callbacks of the host extensions are counted too.
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		host.(evmc.PrecompileChecker).IsPrecompile(address)
+		host.(evmc.InputSizeGetter).GetInputSize()
+		host.(evmc.FrameGetter).GetAddress()
+		host.(evmc.FrameGetter).GetCaller()
+		host.(evmc.OriginNonceGetter).GetOriginNonce()
+		host.(evmc.CodeByHashGetter).GetCodeByHash(common.Hash{})
+		snapshotter := host.(evmc.StateSnapshotter)
+		snapshotter.RevertToSnapshot(snapshotter.Snapshot())
+		return nil, gas, nil
+	})
+	interpreter, contract = newStubEVMC(vm, 1000)
+	want = EVMCCallbackCounts{
+		IsPrecompile: 1, GetInputSize: 1, GetAddress: 1, GetCaller: 1,
+		GetOriginNonce: 1, GetCodeByHash: 1, Snapshot: 1, RevertToSnapshot: 1,
+	}
+	if have := interpreter.RunEx(contract, nil, false).Callbacks; have != want {
+		t.Errorf("extension callback counts mismatch: have %+v, want %+v", have, want)
+	}
+}
+
+func TestEVMCCreateOutOfGas(t *testing.T) {
+	interpreter, _ := newMiniEVMC([]byte{0x00}, 0)
+
+	// PUSH1 0 PUSH1 0 PUSH1 0 PUSH1 0 STOP, running out of gas
+	initCode := []byte{0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x00}
+	_, created, gasLeft, err := interpreter.env.Create(AccountRef(evmcTestAddress), initCode, 3, new(big.Int))
+	if !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("error mismatch: have %v, want %v", err, ErrOutOfGas)
+	}
+	if gasLeft != 0 {
+		t.Errorf("gas left after running out of gas: %d", gasLeft)
+	}
+	if interpreter.env.StateDB.GetCodeSize(created) != 0 || interpreter.env.StateDB.GetNonce(created) != 0 {
+		t.Errorf("failed creation left the account behind")
+	}
+}
+
+func TestEVMCHostSelfdestructBeneficiary(t *testing.T) {
+	for _, balance := range []int64{0, 1000} {
+		var (
+			beneficiary = common.BytesToAddress([]byte("beneficiary"))
+			host        = newTestHost()
+			statedb     = host.env.StateDB.(*state.StateDB)
+		)
+		statedb.AddBalance(evmcTestAddress, big.NewInt(balance))
+		host.Selfdestruct(evmcTestAddress, beneficiary)
+		statedb.Finalise(true)
+
+		// A funded beneficiary is created, an unfunded one is merely touched
+		// and removed as empty (EIP-161), just like with opSuicide.
+		if exist := statedb.Exist(beneficiary); exist != (balance > 0) {
+			t.Errorf("balance %d: beneficiary existence mismatch: have %v, want %v", balance, exist, balance > 0)
+		}
+		if have := statedb.GetBalance(beneficiary); have.Int64() != balance {
+			t.Errorf("balance %d: beneficiary balance mismatch: have %v", balance, have)
+		}
+		if statedb.Exist(evmcTestAddress) {
+			t.Errorf("balance %d: destructed contract kept", balance)
+		}
+	}
+}
+
+func TestEVMCRunExCallRefund(t *testing.T) {
+	// Clear the slot and restore it: PUSH1 0 PUSH1 1 SSTORE PUSH1 1 PUSH1 1 SSTORE STOP
+	interpreter, contract := newMiniEVMC([]byte{0x60, 0x00, 0x60, 0x01, 0x55, 0x60, 0x01, 0x60, 0x01, 0x55, 0x00}, 1000)
+	statedb := interpreter.env.StateDB.(*state.StateDB)
+	statedb.SetState(evmcTestAddress, common.BigToHash(big.NewInt(1)), common.BigToHash(big.NewInt(1)))
+	statedb.Finalise(true)
+	statedb.AddRefund(100) // refunds of earlier calls
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	// The clearing refund is taken back, leaving the refund of the reset.
+	want := int64(vars.SstoreResetGasEIP2200 - vars.SloadGasEIP2200)
+	if result.CallRefund != want {
+		t.Errorf("call refund mismatch: have %d, want %d", result.CallRefund, want)
+	}
+	if result.Refund != 100+uint64(want) {
+		t.Errorf("refund mismatch: have %d, want %d", result.Refund, 100+want)
+	}
+}
+
+func TestEVMCHostCallTouchesEmptyAccount(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		fresh   = common.BytesToAddress([]byte("fresh"))
+		empty   = common.BytesToAddress([]byte("empty"))
+	)
+	host := newTestHost()
+	statedb := host.env.StateDB.(*state.StateDB)
+	statedb.AddBalance(address, big.NewInt(1))
+	statedb.CreateAccount(empty)
+	statedb.Finalise(false) // keep the empty account around until touched
+
+	for _, callee := range []common.Address{fresh, empty} {
+		if _, _, _, err := host.Call(evmc.Call, callee, address, new(big.Int), nil, 100000, 1, false, new(big.Int)); err != nil {
+			t.Fatalf("call to %x failed: %v", callee, err)
+		}
+	}
+	statedb.Finalise(true)
+
+	// The zero value call doesn't create the inexistent account, and removes
+	// the touched empty one (EIP-161).
+	for _, callee := range []common.Address{fresh, empty} {
+		if statedb.Exist(callee) {
+			t.Errorf("empty account %x kept after the call", callee)
+		}
+	}
+	if !statedb.Exist(address) {
+		t.Errorf("calling account removed")
+	}
+}
+
+func TestEVMCHostFrameAccounts(t *testing.T) {
+	var (
+		origin  = common.BytesToAddress([]byte("origin"))
+		address = evmcTestAddress
+		library = common.BytesToAddress([]byte("library"))
+		callee  = common.BytesToAddress([]byte("callee"))
+	)
+	type frame struct{ address, caller common.Address }
+	var frames []frame
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		getter := host.(evmc.FrameGetter)
+		frames = append(frames, frame{getter.GetAddress(), getter.GetCaller()})
+		if depth == 0 {
+			host.Call(evmc.DelegateCall, library, address, new(big.Int), nil, gas/3, depth+1, false, new(big.Int))
+			host.Call(evmc.Call, callee, address, new(big.Int), nil, gas/3, depth+1, false, new(big.Int))
+		}
+		return nil, gas, nil
+	})
+	interpreter, _ := newStubEVMC(vm, 0)
+	interpreter.env.StateDB.SetCode(library, []byte{byte(STOP)})
+	interpreter.env.StateDB.SetCode(callee, []byte{byte(STOP)})
+
+	contract := NewContract(AccountRef(origin), AccountRef(address), new(big.Int), 100000)
+	contract.SetCallCode(&address, crypto.Keccak256Hash([]byte{byte(STOP)}), []byte{byte(STOP)})
+	if _, err := interpreter.Run(contract, nil, false); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	want := []frame{
+		{address, origin}, // outermost frame
+		{address, origin}, // delegatecall: context and caller of the calling frame
+		{callee, address}, // call: the callee called by the calling frame
+	}
+	if fmt.Sprint(frames) != fmt.Sprint(want) {
+		t.Errorf("frame accounts mismatch:\nhave %v\nwant %v", frames, want)
+	}
+}
+
+func TestInitEVMCContext(t *testing.T) {
+	defer func(load func(string) (*evmc.Instance, error)) { evmcLoad = load }(evmcLoad)
+	defer func(init func(evmc.Capability, string) *evmc.Instance) { evmcInit = init }(evmcInit)
+	defer func(destroy func(*evmc.Instance)) { evmcDestroy = destroy }(evmcDestroy)
+
+	// A hanging loader is given up on once the context is done, and the VM
+	// it loads afterwards is destroyed.
+	var (
+		instance  = new(evmc.Instance)
+		entered   = make(chan struct{})
+		release   = make(chan struct{})
+		destroyed = make(chan *evmc.Instance, 1)
+	)
+	evmcInit = func(cap evmc.Capability, config string) *evmc.Instance {
+		close(entered)
+		<-release
+		return instance
+	}
+	evmcDestroy = func(vm *evmc.Instance) { destroyed <- vm }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if have, err := initEVMC(ctx, evmc.CapabilityEVM1, "evmone"); err == nil || !strings.Contains(err.Error(), "aborted") || have != nil {
+		t.Errorf("hanging load not aborted: %v", err)
+	}
+	<-entered
+	close(release)
+	if have := <-destroyed; have != instance {
+		t.Errorf("destroyed instance mismatch: have %p, want %p", have, instance)
+	}
+	// A load completing in time hands the VM over.
+	evmcInit = func(cap evmc.Capability, config string) *evmc.Instance { return instance }
+	if have, err := initEVMC(context.Background(), evmc.CapabilityEVM1, "evmone"); err != nil || have != instance {
+		t.Errorf("loaded instance mismatch: have %p/%v, want %p", have, err, instance)
+	}
+	// Loading failures are reported as before.
+	evmcInit = loadEVMC
+	evmcLoad = func(path string) (*evmc.Instance, error) {
+		return nil, errors.New("broken library")
+	}
+	r := func() (r interface{}) {
+		defer func() { r = recover() }()
+		initEVMC(context.Background(), evmc.CapabilityEVM1, "evmone")
+		return nil
+	}()
+	if r == nil || !strings.Contains(fmt.Sprint(r), "broken library") {
+		t.Errorf("loading failure mismatch: have %v, want broken library", r)
+	}
+}
+
+func TestEVMCRunExPrecompileGas(t *testing.T) {
+	var (
+		address = evmcTestAddress
+		modexp  = common.BytesToAddress([]byte{0x05})
+		// 3^5 mod 7, with 64 bytes long base and modulus to make it cost
+		input = bytes.Join([][]byte{
+			common.LeftPadBytes([]byte{64}, 32), common.LeftPadBytes([]byte{1}, 32), common.LeftPadBytes([]byte{64}, 32),
+			common.LeftPadBytes([]byte{3}, 64), {5}, common.LeftPadBytes([]byte{7}, 64),
+		}, nil)
+	)
+	var callErrs []error
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		// A successful call, and a call failing with too little gas.
+		_, gasLeft, _, err := host.Call(evmc.Call, modexp, address, new(big.Int), input, 10000, depth+1, false, new(big.Int))
+		callErrs = append(callErrs, err)
+		gas -= 10000 - gasLeft
+		_, _, _, err = host.Call(evmc.Call, modexp, address, new(big.Int), input, 10, depth+1, false, new(big.Int))
+		callErrs = append(callErrs, err)
+		return nil, gas - 10, nil
+	})
+	interpreter, contract := newStubEVMC(vm, 100000)
+	p, ok := interpreter.env.precompile(modexp)
+	if !ok {
+		t.Fatal("modexp not active")
+	}
+	required := p.RequiredGas(input)
+	if required <= 10 || required >= 10000 {
+		t.Fatalf("unsuitable modexp cost %d", required)
+	}
+
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	if callErrs[0] != nil || callErrs[1] != evmc.Failure {
+		t.Errorf("call errors mismatch: have %v, want [<nil> %v]", callErrs, evmc.Failure)
+	}
+	if want := required + 10; result.PrecompileGas != want { // the failed call consumes all its gas
+		t.Errorf("precompile gas mismatch: have %d, want %d", result.PrecompileGas, want)
+	}
+}
+
+func TestEVMCBigToHash(t *testing.T) {
+	for _, n := range []*big.Int{
+		new(big.Int),
+		big.NewInt(1),
+		new(big.Int).Lsh(big.NewInt(1), 64),
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1)),
+		new(big.Int).Lsh(big.NewInt(3), 255), // wider than a hash, truncated
+	} {
+		if have, want := bigToHash(n), common.BigToHash(n); have != want {
+			t.Errorf("%v: hash mismatch: have %x, want %x", n, have, want)
+		}
+	}
+}
+
+func BenchmarkEVMCHostGetBalance(b *testing.B) {
+	host := newTestHost()
+	host.env.StateDB.AddBalance(evmcTestAddress, new(big.Int).Lsh(big.NewInt(1), 200))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		host.GetBalance(evmcTestAddress)
+	}
+}
+
+// nonReentrantVM is a stub EVMC VM reporting not to be reentrant. Like the
+// stub, it isn't comparable.
+type nonReentrantVM struct {
+	stubEVMCVM
+}
+
+func (nonReentrantVM) Reentrant() bool { return false }
+
+func TestEVMCNonReentrantVM(t *testing.T) {
+	// A contract calling itself, which re-enters the VM.
+	var frames int
+	recursive := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		frames++
+		if depth == 0 {
+			_, gasLeft, _, err := host.Call(evmc.Call, evmcTestAddress, evmcTestAddress, new(big.Int), nil, gas/2, depth+1, false, new(big.Int))
+			if err != nil {
+				return nil, gas / 2, nil
+			}
+			return nil, gas/2 + gasLeft, nil
+		}
+		return nil, gas, nil
+	})
+	for _, tt := range []struct {
+		vm     evmcVM
+		frames int
+	}{
+		{recursive, 2},                 // reentrant VMs run the nested frame
+		{nonReentrantVM{recursive}, 1}, // others fail it
+	} {
+		frames = 0
+		interpreter, contract := newStubEVMC(tt.vm, 100000)
+		if _, err := interpreter.Run(contract, nil, false); err != nil {
+			t.Fatalf("execution failed: %v", err)
+		}
+		if frames != tt.frames {
+			t.Errorf("%T: executed frame count mismatch: have %d, want %d", tt.vm, frames, tt.frames)
+		}
+	}
+
+	// Concurrent executions on a non-reentrant VM are serialized.
+	var active, maxActive int32
+	vm := nonReentrantVM{func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			seen := atomic.LoadInt32(&maxActive)
+			if n <= seen || atomic.CompareAndSwapInt32(&maxActive, seen, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil, gas, nil
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		interpreter, contract := newStubEVMC(vm, 100000)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interpreter.Run(contract, nil, false)
+		}()
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		t.Errorf("concurrent executions on non-reentrant VM: have %d, want 1", maxActive)
+	}
+}
+
+// Tests that non-reentrant VMs are told apart by instance rather than by the
+// interpreter running them, and that EVMs calling across two such VMs in
+// opposite directions don't deadlock.
+func TestEVMCNonReentrantCrossCalls(t *testing.T) {
+	var (
+		evmAddr  = common.BytesToAddress([]byte("evm1"))
+		wasmAddr = common.BytesToAddress([]byte("ewasm"))
+		wasmCode = []byte("\x00asm\x01\x00\x00\x00")
+		failed   int32
+	)
+	// crossCall returns a VM calling callee from its outermost frame, counting
+	// the failed calls.
+	crossCall := func(self, callee common.Address) *nonReentrantVM {
+		return &nonReentrantVM{func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+			if depth > 0 {
+				return nil, gas, nil
+			}
+			time.Sleep(time.Millisecond)
+			_, gasLeft, _, err := host.Call(evmc.Call, callee, self, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+			if err != nil {
+				atomic.AddInt32(&failed, 1)
+			}
+			return nil, gasLeft, nil
+		}}
+	}
+	// newMixedEVM returns an EVM with the given VMs, and a contract entering it
+	// at the given address.
+	newMixedEVM := func(evm1, ewasm evmcVM, entry common.Address) (*EVM, *Contract) {
+		interpreter, _ := newTestEVMC(evm1, evmAddr, 0)
+		env := interpreter.env
+		env.interpreters = []Interpreter{
+			&EVMC{instance: ewasm, env: env, cap: evmc.CapabilityEWASM},
+			interpreter,
+		}
+		env.StateDB.SetCode(wasmAddr, wasmCode)
+
+		code := env.StateDB.GetCode(entry)
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(entry), new(big.Int), 100000)
+		contract.SetCallCode(&entry, crypto.Keccak256Hash(code), code)
+		return env, contract
+	}
+	evm1, ewasm := crossCall(evmAddr, wasmAddr), crossCall(wasmAddr, evmAddr)
+
+	// The same VM behind both interpreters is reentered by the nested frame.
+	for _, tt := range []struct {
+		ewasm  evmcVM
+		failed int32
+	}{
+		{evm1, 1},
+		{ewasm, 0},
+	} {
+		failed = 0
+		env, contract := newMixedEVM(evm1, tt.ewasm, evmAddr)
+		if _, err := run(env, contract, nil, false); err != nil {
+			t.Fatalf("execution failed: %v", err)
+		}
+		if failed != tt.failed {
+			t.Errorf("failed sub-call count mismatch: have %d, want %d", failed, tt.failed)
+		}
+	}
+
+	// Concurrent EVMs entering the VMs from opposite ends.
+	failed = 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			for _, entry := range []common.Address{evmAddr, wasmAddr} {
+				env, contract := newMixedEVM(evm1, ewasm, entry)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					run(env, contract, nil, false)
+				}()
+			}
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("executions calling across non-reentrant VMs deadlocked")
+	}
+	if failed != 0 {
+		t.Errorf("failed sub-call count mismatch: have %d, want 0", failed)
+	}
+}
+
+func TestEVMCHostOriginNonce(t *testing.T) {
+	var (
+		origin  = common.BytesToAddress([]byte("origin"))
+		address = evmcTestAddress
+		nonces  []uint64
+		statedb StateDB
+	)
+	vm := stubEVMCVM(func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		nonces = append(nonces, host.(evmc.OriginNonceGetter).GetOriginNonce())
+		if depth == 0 {
+			// The nonce of the origin changes during the transaction.
+			statedb.SetNonce(origin, statedb.GetNonce(origin)+1)
+			_, gasLeft, _, err := host.Call(evmc.Call, address, address, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+			return nil, gasLeft, err
+		}
+		return nil, gas, nil
+	})
+	interpreter, contract := newStubEVMC(vm, 100000)
+	interpreter.env.Origin = origin
+	interpreter.env.OriginNonce = 5
+	statedb = interpreter.env.StateDB
+	statedb.SetNonce(origin, 6) // incremented by the state transition
+
+	if _, err := interpreter.Run(contract, nil, false); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if fmt.Sprint(nonces) != "[5 5]" {
+		t.Errorf("origin nonces mismatch: have %v, want [5 5]", nonces)
+	}
+}
+
+func TestEVMCStats(t *testing.T) {
+	var (
+		callee = common.BytesToAddress([]byte{0x42})
+		stats  = new(evmcStats)
+		want   EVMCStats
+	)
+	// Frames ending with the given status: PUSH1 status INVALID
+	for _, status := range []evmc.Error{0, evmc.Revert, evmc.OutOfGas, evmc.Failure, 0} {
+		interpreter, contract := newMiniEVMC([]byte{0x60, byte(status), 0xef}, 100)
+		interpreter.stats = stats
+		result := interpreter.RunEx(contract, nil, false)
+
+		want.Executions++
+		want.Outermost++
+		want.Gas += result.GasUsed
+		switch status {
+		case evmc.Revert:
+			want.Reverts++
+		case evmc.OutOfGas:
+			want.OutOfGas++
+		case evmc.Failure:
+			want.Failures++
+		}
+	}
+	// A frame calling another one only accounts the gas of the outermost:
+	// PUSH1 0x42 CALL STOP
+	interpreter, contract := newMiniEVMC([]byte{0x60, 0x42, 0xf1, 0x00}, 1000)
+	interpreter.stats = stats
+	// PUSH1 1 SLOAD STOP
+	interpreter.env.StateDB.SetCode(callee, []byte{0x60, 0x01, 0x54, 0x00})
+	result := interpreter.RunEx(contract, nil, false)
+	if result.Err != nil {
+		t.Fatalf("execution failed: %v", result.Err)
+	}
+	want.Executions += 2
+	want.Outermost++
+	want.Gas += result.GasUsed
+
+	// Frames not reaching the VM are accounted too: empty code, and the
+	// nested frame of a non-reentrant VM.
+	interpreter, contract = newMiniEVMC(nil, 1000)
+	interpreter.stats = stats
+	interpreter.RunEx(contract, nil, false)
+	want.Executions++
+	want.Outermost++
+
+	vm := nonReentrantVM{func(host evmc.HostContext, kind evmc.CallKind, static bool, depth int, gas int64) ([]byte, int64, error) {
+		if depth > 0 {
+			return nil, gas, nil
+		}
+		_, gasLeft, _, _ := host.Call(evmc.Call, evmcTestAddress, evmcTestAddress, new(big.Int), nil, gas, depth+1, false, new(big.Int))
+		return nil, gasLeft, nil
+	}}
+	interpreter, contract = newStubEVMC(vm, 1000)
+	interpreter.stats = stats
+	result = interpreter.RunEx(contract, nil, false)
+	want.Executions += 2
+	want.Outermost++
+	want.Failures++
+	want.Gas += result.GasUsed
+
+	have := stats.snapshot()
+	if have.Duration <= 0 || have.AverageDuration() != have.Duration/time.Duration(have.Outermost) {
+		t.Errorf("duration mismatch: total %v, average %v", have.Duration, have.AverageDuration())
+	}
+	have.Duration = 0
+	if have != want {
+		t.Errorf("statistics mismatch: have %+v, want %+v", have, want)
+	}
+	if (EVMCStats{}).AverageDuration() != 0 {
+		t.Errorf("average duration of no executions mismatch: have %v, want 0", (EVMCStats{}).AverageDuration())
+	}
+	// Statistics are kept per loaded VM, Go VMs don't collect them.
+	a, b := new(evmcModule), new(evmcModule)
+	if evmcStatsOf(a) != &a.stats || evmcStatsOf(b) != &b.stats {
+		t.Errorf("statistics not kept per loaded VM")
+	}
+	if evmcStatsOf(vm) != nil || evmcStatsOf((*evmcModule)(nil)) != nil {
+		t.Errorf("statistics collected for a VM not loaded")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+// UseMiniEVMC makes the EVMC EVM1 interpreters of new EVMs run miniEVMCVM
+// instead of a loaded VM, until the returned function is called. It lets the
+// external tests of this package (vm_test), which may import core, run whole
+// transactions through EVMC.
+func UseMiniEVMC() (restore func()) {
+	vms := evmcVMs
+	evmcVMs = func() (evmcVM, evmcVM) { return miniEVMCVM{}, nil }
+	return func() { evmcVMs = vms }
+}
@@ -36,6 +36,7 @@ type StateDB interface {
 
 	GetCodeHash(common.Address) common.Hash
 	GetCode(common.Address) []byte
+	GetCodeByHash(common.Hash) []byte
 	SetCode(common.Address, []byte)
 	GetCodeSize(common.Address) int
 
@@ -19,6 +19,7 @@ package vm
 import (
 	"hash"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
@@ -34,10 +35,18 @@ type Config struct {
 
 	JumpTable [256]*operation // EVM instruction table, automatically populated if unset
 
-	EWASMInterpreter string // External EWASM interpreter options
-	EVMInterpreter   string // External EVM interpreter options
+	EWASMInterpreter  string             // External EWASM interpreter options
+	EVMInterpreter    string             // External EVM interpreter options
+	EVMCGasProfiling  bool               // Enables gas profiling of the EVMC host operations
+	EVMCTimeout       time.Duration      // Wall-clock limit of an EVMC execution (0 = unlimited)
+	EVMCGasMeter      EVMCGasMeterFunc   // Callback notified of the gas used by EVMC host sub-calls
+	EVMCSimulationGas uint64             // Gas budget of EVMC executions simulated by embedders, unused by eth_call (0 = disabled)
+	EVMCMaxOutputSize int                // Size limit of the data returned to and by EVMC VMs, breaks consensus if hit (0 = unlimited)
+	EVMCNoopSStore    EVMCNoopSStoreFunc // Storage status of SSTOREs not changing the value (nil = unchanged)
 
 	ExtraEips []int // Additional EIPS that are to be enabled
+
+	CustomPrecompiles []CustomPrecompile // Chain specific precompiles, taking precedence over the protocol ones
 }
 
 // Interpreter is used to run Ethereum based contracts and will utilise the
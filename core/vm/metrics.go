@@ -0,0 +1,63 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the metrics collected by the virtual machine.
+
+package vm
+
+import (
+	"github.com/ethereum/go-ethereum/evmc/bindings/go/evmc"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	evmcEVM1SelectCounter  = metrics.NewRegisteredCounter("vm/select/evmc/evm1", nil)
+	evmcEwasmSelectCounter = metrics.NewRegisteredCounter("vm/select/evmc/ewasm", nil)
+	nativeSelectCounter    = metrics.NewRegisteredCounter("vm/select/native", nil)
+
+	// Fallbacks, labeled by the reason the preferred interpreter wasn't used.
+	ewasmFallbackCounter         = metrics.NewRegisteredCounter("vm/select/fallback/noewasm", nil)
+	noInterpreterFallbackCounter = metrics.NewRegisteredCounter("vm/select/fallback/none", nil)
+)
+
+// markInterpreterSelection updates the VM selection counters for the given
+// code being routed to interpreter. A nil interpreter means no interpreter
+// was able to run the code.
+func markInterpreterSelection(interpreter Interpreter, code []byte) {
+	wasm := isWasmCode(code)
+
+	switch in := interpreter.(type) {
+	case nil:
+		if wasm {
+			ewasmFallbackCounter.Inc(1)
+		} else {
+			noInterpreterFallbackCounter.Inc(1)
+		}
+	case *EVMC:
+		if in.cap == evmc.CapabilityEWASM {
+			evmcEwasmSelectCounter.Inc(1)
+		} else {
+			evmcEVM1SelectCounter.Inc(1)
+		}
+	default:
+		nativeSelectCounter.Inc(1)
+		// The native interpreter accepts any code, so Ewasm code ending
+		// up here means no Ewasm VM was loaded to take it.
+		if wasm {
+			ewasmFallbackCounter.Inc(1)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/evmc/bindings/go/evmc"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+func TestInterpreterSelectionMetrics(t *testing.T) {
+	// Swap in live counters, the registered ones are no-ops unless metrics
+	// were enabled before the package got initialised.
+	counters := []*metrics.Counter{
+		&evmcEVM1SelectCounter, &evmcEwasmSelectCounter, &nativeSelectCounter,
+		&ewasmFallbackCounter, &noInterpreterFallbackCounter,
+	}
+	for _, c := range counters {
+		defer func(c *metrics.Counter, old metrics.Counter) { *c = old }(c, *c)
+		*c = metrics.NewCounterForced()
+	}
+	var (
+		evmCode  = []byte{0x60, 0x00}
+		wasmCode = []byte("\x00asm\x01\x00\x00\x00")
+
+		evm1  = &EVMC{cap: evmc.CapabilityEVM1}
+		ewasm = &EVMC{cap: evmc.CapabilityEWASM}
+	)
+	markInterpreterSelection(evm1, evmCode)
+	markInterpreterSelection(ewasm, wasmCode)
+	markInterpreterSelection(ewasm, wasmCode)
+	markInterpreterSelection(&EVMInterpreter{}, evmCode)
+	markInterpreterSelection(&EVMInterpreter{}, wasmCode) // native fallback, no Ewasm VM
+	markInterpreterSelection(nil, wasmCode)               // only EVMC EVM1 loaded
+	markInterpreterSelection(nil, evmCode)
+
+	tests := []struct {
+		name    string
+		counter metrics.Counter
+		want    int64
+	}{
+		{"evmc/evm1", evmcEVM1SelectCounter, 1},
+		{"evmc/ewasm", evmcEwasmSelectCounter, 2},
+		{"native", nativeSelectCounter, 2},
+		{"fallback/noewasm", ewasmFallbackCounter, 2},
+		{"fallback/none", noInterpreterFallbackCounter, 1},
+	}
+	for _, tt := range tests {
+		if have := tt.counter.Count(); have != tt.want {
+			t.Errorf("%s: counter mismatch: have %d, want %d", tt.name, have, tt.want)
+		}
+	}
+}
@@ -127,8 +127,9 @@ func (err Error) Error() string {
 }
 
 const (
-	Failure = Error(C.EVMC_FAILURE)
-	Revert  = Error(C.EVMC_REVERT)
+	Failure  = Error(C.EVMC_FAILURE)
+	Revert   = Error(C.EVMC_REVERT)
+	OutOfGas = Error(C.EVMC_OUT_OF_GAS)
 )
 
 type Revision int32
@@ -144,6 +145,9 @@ const (
 	Istanbul         Revision = C.EVMC_ISTANBUL
 )
 
+// ABIVersion is the EVMC ABI version the bindings are built against.
+const ABIVersion = int(C.EVMC_ABI_VERSION)
+
 type Instance struct {
 	handle *C.struct_evmc_instance
 }
@@ -202,6 +206,11 @@ func (instance *Instance) Version() string {
 	return C.GoString(instance.handle.version)
 }
 
+// ABIVersion returns the EVMC ABI version implemented by the VM instance.
+func (instance *Instance) ABIVersion() int {
+	return int(instance.handle.abi_version)
+}
+
 type Capability uint32
 
 const (
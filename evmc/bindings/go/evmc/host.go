@@ -96,6 +96,71 @@ type HostContext interface {
 		static bool, salt *big.Int) (output []byte, gasLeft int64, createAddr common.Address, err error)
 }
 
+// StateSnapshotter is an optional extension of HostContext for VMs managing
+// state reverts themselves instead of relying on the host to revert failed
+// sub-calls.
+type StateSnapshotter interface {
+	// Snapshot returns an identifier for the current state.
+	Snapshot() int
+	// RevertToSnapshot reverts all state changes made since the snapshot with
+	// the given identifier was taken, including later snapshots.
+	RevertToSnapshot(id int)
+}
+
+// PrecompileChecker is an optional extension of HostContext telling whether
+// an address holds a precompiled contract in the current revision.
+type PrecompileChecker interface {
+	// IsPrecompile reports whether addr is an active precompiled contract.
+	IsPrecompile(addr common.Address) bool
+}
+
+// InputSizeGetter is an optional extension of HostContext exposing the size of
+// the input data of the executing frame, for tracing.
+type InputSizeGetter interface {
+	// GetInputSize returns the size of the input data of the current frame.
+	GetInputSize() int
+}
+
+// FrameGetter is an optional extension of HostContext exposing the accounts of
+// the executing frame, for tracers and VMs not keeping the execution
+// parameters around.
+type FrameGetter interface {
+	// GetAddress returns the address of the account the frame executes on
+	// behalf of, which is the one of the calling frame for DELEGATECALL and
+	// CALLCODE.
+	GetAddress() common.Address
+	// GetCaller returns the caller of the frame, which is the caller of the
+	// calling frame for DELEGATECALL.
+	GetCaller() common.Address
+}
+
+// OriginNonceGetter is an optional extension of HostContext exposing the nonce
+// the origin of the transaction had when the transaction started, for tracing
+// and account abstraction. The EVMC tx context has no such field.
+type OriginNonceGetter interface {
+	// GetOriginNonce returns the nonce of the transaction origin at the start
+	// of the transaction, unaffected by later nonce changes.
+	GetOriginNonce() uint64
+}
+
+// CodeByHashGetter is an optional extension of HostContext for VMs wanting to
+// prefetch code by its hash, e.g. to warm a JIT cache. The EVMC ABI has no
+// callback for it, so it is only reachable by VMs driven from Go.
+type CodeByHashGetter interface {
+	// GetCodeByHash returns the code with the given hash, or nil if unknown.
+	GetCodeByHash(hash common.Hash) []byte
+}
+
+// CodeSliceGetter is an optional extension of HostContext. If implemented,
+// it is used to serve EXTCODECOPY instead of GetCode, so only the requested
+// window of the code is handed over to the VM.
+type CodeSliceGetter interface {
+	// GetCodeSlice returns the code at addr within the window of size bytes
+	// starting at offset, truncated at the end of the code. The VM pads the
+	// rest of the window with zeros. The slice must not be modified.
+	GetCodeSlice(addr common.Address, offset uint64, size uint64) []byte
+}
+
 //export accountExists
 func accountExists(pCtx unsafe.Pointer, pAddr *C.evmc_address) C.bool {
 	idx := int((*C.struct_extended_context)(pCtx).index)
@@ -142,6 +207,10 @@ func getCodeHash(pCtx unsafe.Pointer, pAddr *C.evmc_address) C.evmc_bytes32 {
 func copyCode(pCtx unsafe.Pointer, pAddr *C.evmc_address, offset C.size_t, p *C.uint8_t, size C.size_t) C.size_t {
 	idx := int((*C.struct_extended_context)(pCtx).index)
 	ctx := getHostContext(idx)
+	if getter, ok := ctx.(CodeSliceGetter); ok {
+		out := goByteSlice(p, size)
+		return C.size_t(copy(out, getter.GetCodeSlice(goAddress(*pAddr), uint64(offset), uint64(size))))
+	}
 	code := ctx.GetCode(goAddress(*pAddr))
 	length := C.size_t(len(code))
 
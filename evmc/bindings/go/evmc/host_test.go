@@ -6,8 +6,10 @@ package evmc
 
 import (
 	"bytes"
+	"fmt"
 	"math/big"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -118,3 +120,90 @@ func TestCall(t *testing.T) {
 		t.Error("execution returned unexpected error")
 	}
 }
+
+// numberHostContext is a host context reporting the given block number.
+type numberHostContext struct {
+	testHostContext
+	number int64
+}
+
+func (host *numberHostContext) GetTxContext() TxContext {
+	return TxContext{Number: host.number}
+}
+
+// Tests that concurrent executions on the same VM instance are each served by
+// their own host context.
+func TestConcurrentHostContexts(t *testing.T) {
+	if _, err := os.Open(modulePath); os.IsNotExist(err) {
+		t.Skipf("skipping evmc test: file %s does not exist", modulePath)
+	}
+	vm, _ := Load(modulePath)
+	defer vm.Destroy()
+
+	code := []byte("\x43\x60\x00\x52\x59\x60\x00\xf3")
+	addr := common.Address{}
+	h := common.Hash{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := int64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(host *numberHostContext) {
+			defer wg.Done()
+			want := []byte(fmt.Sprintf("%d\x00", host.number))
+			for j := 0; j < 100; j++ {
+				output, _, err := vm.Execute(host, Byzantium, Call, false, 1, 100, addr, addr, nil, h, code, h)
+				if err != nil || !bytes.HasPrefix(output, want) {
+					errs <- fmt.Errorf("host %d: unexpected output %q (%v)", host.number, output, err)
+					return
+				}
+			}
+		}(&numberHostContext{number: 10 + i})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	hostContextMapMu.Lock()
+	defer hostContextMapMu.Unlock()
+	if len(hostContextMap) != 0 {
+		t.Errorf("host contexts left registered: %d", len(hostContextMap))
+	}
+}
+
+// Tests that the host contexts of concurrent executions are kept apart by the
+// registry the callbacks look them up in, without a VM being needed.
+func TestHostContextRegistry(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := int64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(host *numberHostContext) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := addHostContext(host)
+				number := getHostContext(id).GetTxContext().Number
+				removeHostContext(id)
+				if number != host.number {
+					errs <- fmt.Errorf("host %d: looked up host %d", host.number, number)
+					return
+				}
+				if getHostContext(id) != nil {
+					errs <- fmt.Errorf("host %d: found after removal", host.number)
+					return
+				}
+			}
+		}(&numberHostContext{number: 10 + i})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	hostContextMapMu.Lock()
+	defer hostContextMapMu.Unlock()
+	if len(hostContextMap) != 0 {
+		t.Errorf("host contexts left registered: %d", len(hostContextMap))
+	}
+}